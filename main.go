@@ -1,19 +1,21 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
-	"net/smtp"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sendmail/sender"
 	"sendmail/utils"
 	"strconv"
-	"sync"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
@@ -56,6 +58,37 @@ func main() {
 				Value: "to@example.com",
 				Usage: "设置SMTP收件人",
 			},
+			&cli.StringFlag{
+				Name:  "rcptFile",
+				Value: "",
+				Usage: "指定收件人列表文件，每行一个收件人或CSV格式，可以有表头，CSV中只使用地址列，设置后代替--to",
+			},
+			&cli.IntFlag{
+				Name:  "rcptPerMessage",
+				Value: 1,
+				Usage: "设置每封邮件的收件人数",
+			},
+			&cli.StringFlag{
+				Name:  "rcptMode",
+				Value: sender.RcptRoundRobin,
+				Usage: "设置收件人分配方式 roundrobin,random",
+				Action: func(context *cli.Context, s string) error {
+					if s != sender.RcptRoundRobin && s != sender.RcptRandom {
+						return fmt.Errorf("不支持的收件人分配方式：%s", s)
+					}
+					return nil
+				},
+			},
+			&cli.BoolFlag{
+				Name:  "envelopeFromHeaders",
+				Value: false,
+				Usage: "根据邮件头生成信封，发件人取Return-Path、Sender、From，收件人取To、Cc、Bcc、Delivered-To、X-Original-To",
+			},
+			&cli.BoolFlag{
+				Name:  "xclient",
+				Value: false,
+				Usage: "服务器支持XCLIENT时使用原始信封中的客户端IP，登录模式下先发送XCLIENT再认证",
+			},
 			&cli.StringFlag{
 				Name:  "server",
 				Value: "127.0.0.1",
@@ -72,6 +105,52 @@ func main() {
 					return nil
 				},
 			},
+			&cli.StringFlag{
+				Name:  "tls",
+				Value: sender.TLSAuto,
+				Usage: "设置TLS模式 auto,none,starttls,starttls-required,implicit，auto表示25端口不使用TLS，其余端口使用implicit",
+				Action: func(context *cli.Context, s string) error {
+					if !sender.ValidTLSMode(s) {
+						return fmt.Errorf("不支持的TLS模式：%s", s)
+					}
+					return nil
+				},
+			},
+			&cli.BoolFlag{
+				Name:  "tlsVerify",
+				Value: false,
+				Usage: "校验服务器证书，默认跳过校验",
+			},
+			&cli.StringFlag{
+				Name:  "caFile",
+				Value: "",
+				Usage: "设置校验服务器证书使用的CA证书文件，设置后总是校验服务器证书",
+			},
+			&cli.StringFlag{
+				Name:  "sni",
+				Value: "",
+				Usage: "设置TLS握手的SNI及证书校验的主机名，默认使用--server",
+			},
+			&cli.StringFlag{
+				Name:  "tlsMinVersion",
+				Value: "",
+				Usage: "设置TLS最低版本 1.0,1.1,1.2,1.3",
+			},
+			&cli.StringFlag{
+				Name:  "tlsMaxVersion",
+				Value: "",
+				Usage: "设置TLS最高版本 1.0,1.1,1.2,1.3",
+			},
+			&cli.StringFlag{
+				Name:  "clientCert",
+				Value: "",
+				Usage: "设置客户端证书文件，用于双向TLS认证",
+			},
+			&cli.StringFlag{
+				Name:  "clientKey",
+				Value: "",
+				Usage: "设置客户端证书私钥文件",
+			},
 			&cli.IntFlag{
 				Name:  "sleep",
 				Value: 0,
@@ -88,11 +167,105 @@ func main() {
 					return nil
 				},
 			},
+			&cli.Float64Flag{
+				Name:  "rate",
+				Value: 0,
+				Usage: "设置每秒派发的邮件数，所有线程共用，为0时不限制",
+			},
+			&cli.IntFlag{
+				Name:  "burst",
+				Value: 1,
+				Usage: "设置按rate限速时允许突发派发的邮件数",
+			},
+			&cli.Float64Flag{
+				Name:  "byteRate",
+				Value: 0,
+				Usage: "设置每秒派发的邮件字节数，所有线程共用，为0时不限制",
+			},
+			&cli.IntFlag{
+				Name:  "byteBurst",
+				Value: 0,
+				Usage: "设置按byteRate限速时允许突发派发的字节数，为0时等于byteRate",
+			},
+			&cli.StringFlag{
+				Name:  "profile",
+				Value: "",
+				Usage: "设置负载曲线，多个阶段以逗号分隔，如 ramp:10:100:5m,soak:100:30m,spike:500:30s,step:100:200:20:1m，设置后代替rate",
+			},
+			&cli.BoolFlag{
+				Name:  "openModel",
+				Value: false,
+				Usage: "按开放模型发送，按rate或profile的速率为每封邮件新建连接，不等待之前的邮件完成，不受thread限制",
+			},
+			&cli.StringFlag{
+				Name:  "arrival",
+				Value: "poisson",
+				Usage: "设置开放模型的到达间隔分布 poisson,fixed",
+			},
+			&cli.IntFlag{
+				Name:  "maxInFlight",
+				Value: 1000,
+				Usage: "设置开放模型中进行中的邮件数上限，达到上限时放弃发送，为0时不限制",
+			},
+			&cli.BoolFlag{
+				Name:  "faithful",
+				Value: false,
+				Usage: "按邮件原始的到达时间间隔派发邮件，重放clickhouse时按时间列排序，设置后忽略sleep",
+			},
+			&cli.Float64Flag{
+				Name:  "speed",
+				Value: 1,
+				Usage: "设置按原始间隔派发时的倍速，如 10 表示间隔缩短为原来的十分之一",
+			},
+			&cli.DurationFlag{
+				Name:  "maxGap",
+				Value: 0,
+				Usage: "设置按原始间隔派发时两封邮件之间的最大间隔，如 5s，为0时不限制",
+			},
+			&cli.IntFlag{
+				Name:  "messagesPerConn",
+				Value: 1,
+				Usage: "设置每条连接发送的邮件数，大于1时复用连接，每封邮件之间发送RSET",
+			},
+			&cli.DurationFlag{
+				Name:  "idleTimeout",
+				Value: 0,
+				Usage: "设置复用连接的空闲超时时间，如 30s，为0时不关闭空闲连接",
+			},
+			&cli.BoolFlag{
+				Name:  "pipelining",
+				Value: false,
+				Usage: "服务器支持PIPELINING时批量发送MAIL、RCPT和DATA命令",
+			},
+			&cli.BoolFlag{
+				Name:  "chunking",
+				Value: false,
+				Usage: "服务器支持CHUNKING时使用BDAT发送邮件内容",
+			},
+			&cli.IntFlag{
+				Name:  "chunkSize",
+				Value: 1024 * 1024,
+				Usage: "设置BDAT每个分块的字节数",
+			},
 			&cli.IntFlag{
 				Name:  "timeThreshold",
 				Value: 0,
 				Usage: "设置发送邮件的时间阈值",
 			},
+			&cli.DurationFlag{
+				Name:  "summaryInterval",
+				Value: 0,
+				Usage: "设置统计时间段的长度，如 10s，大于0时在汇总中按时间段输出吞吐量和耗时分布",
+			},
+			&cli.StringSliceFlag{
+				Name:  "report",
+				Usage: "设置结果报告文件，以.csv结尾时为CSV格式，否则为JSON Lines格式，可以设置多次",
+			},
+			&cli.StringFlag{
+				Name:  "metricsAddr",
+				Value: "",
+				Usage: "设置指标服务的监听地址，如 :9100，设置后在/metrics提供Prometheus格式的运行指标",
+			},
 			&cli.StringFlag{
 				Name:  "accountConfig",
 				Value: "",
@@ -110,29 +283,13 @@ func main() {
 				Name:   "Anonymous",
 				Usage:  "匿名发送eml文件",
 				Action: anonymousSenderMode,
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:  "dir",
-						Value: "",
-						Usage: "设置eml文件目录",
-						Action: func(context *cli.Context, s string) error {
-							// 判断s是否为路径
-							_, err := os.Stat(s)
-							if err != nil {
-								log.Info("dir必须为目录")
-								return err
-							}
-							return nil
-						},
-						Required: true,
-					},
-				},
+				Flags:  sourceFlags("dir"),
 			},
 			{
 				Name:   "Login",
 				Usage:  "登录邮件服务器发送eml文件",
 				Action: loginSenderMode,
-				Flags: []cli.Flag{
+				Flags: append(sourceFlags("dir"),
 					&cli.StringFlag{
 						Name:  "password",
 						Value: "",
@@ -145,100 +302,54 @@ func main() {
 						},
 						// Required: true,
 					},
-					&cli.StringFlag{
-						Name:  "dir",
-						Value: "",
-						Usage: "设置eml文件目录",
-						Action: func(context *cli.Context, s string) error {
-							// 判断s是否为路径
-							_, err := os.Stat(s)
-							if err != nil {
-								log.Info("登录模式下dir必须为目录")
-								return err
-							}
-							return nil
-						},
-						Required: true,
-					},
-				},
+				),
 			},
 			{
 				Name:   "Replay",
 				Usage:  "从minio中提取eml文件进行重放",
 				Action: replaySenderMode,
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:  "minio",
-						Value: "127.0.0.1",
-						Usage: "设置minio的IP地址",
-					},
-					&cli.IntFlag{
-						Name:  "minioPort",
-						Value: 7000,
-						Usage: "设置minio的端口",
-						Action: func(context *cli.Context, i int) error {
-							if i >= 65535 {
-								log.Info("端口必须小于65535")
-							}
-							return nil
-						},
-					},
-					&cli.StringFlag{
-						Name:  "minioUser",
-						Value: "minioadmin",
-						Usage: "设置minio用户名",
-					},
-					&cli.StringFlag{
-						Name:  "minioPassword",
-						Value: "minioadmin",
-						Usage: "设置minio密码",
-						Action: func(context *cli.Context, s string) error {
-							if s == "" {
-								log.Info("minio密码不能为空")
-							}
-							return nil
-						},
-					},
+				Flags:  sourceFlags("clickhouse"),
+			},
+			{
+				Name:   "Export",
+				Usage:  "按Replay的查询条件将eml文件导出到本地目录或tar归档",
+				Action: exportMode,
+				Flags: append(sourceFlags("clickhouse"),
 					&cli.StringFlag{
-						Name:  "clickhouse",
-						Value: "127.0.0.1",
-						Usage: "设置clickhouse的IP地址",
-					},
-					&cli.IntFlag{
-						Name:  "ckPort",
-						Value: 9000,
-						Usage: "设置clickhouse的端口",
-						Action: func(context *cli.Context, i int) error {
-							if i >= 65535 {
-								log.Info("端口必须小于65535")
-							}
-							return nil
-						},
+						Name:  "out",
+						Value: "",
+						Usage: "设置导出目录，目录中同时生成manifest.jsonl清单",
 					},
 					&cli.StringFlag{
-						Name:  "ckUser",
-						Value: "default",
-						Usage: "设置clickhouse的登录用户名",
+						Name:  "tar",
+						Value: "",
+						Usage: "设置导出的tar归档文件，以.gz或.tgz结尾时使用gzip压缩",
 					},
+				),
+			},
+			{
+				Name:   "Report",
+				Usage:  "根据--report生成的结果报告生成带图表的HTML页面",
+				Action: reportMode,
+				Flags: []cli.Flag{
 					&cli.StringFlag{
-						Name:  "ckPassword",
-						Value: "password",
-						Usage: "设置clickhouse的登录密码",
+						Name:  "in",
+						Value: "",
+						Usage: "设置结果报告文件，支持JSON Lines和CSV格式",
 					},
 					&cli.StringFlag{
-						Name:  "ckDatabase",
-						Value: "default",
-						Usage: "设置clickhouse中的数据库",
+						Name:  "out",
+						Value: "",
+						Usage: "设置生成的HTML文件，默认为结果报告文件名加.html",
 					},
 					&cli.StringFlag{
-						Name:  "startTime",
-						Value: "2006-01-02 15:04:05",
-						Usage: "设置clickhouse中数据的开始时间",
+						Name:  "title",
+						Value: "",
+						Usage: "设置页面标题，默认为结果报告文件名",
 					},
-					&cli.StringFlag{
-						Name:  "endTime",
-						Value: time.Now().Format("2006-01-02 15:04:05"),
-						Usage: "设置clickhouse中数据的结束时间",
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "设置图表中每个点的统计时间段，如 10s，为0或点数超过2000时按运行时长自动选择",
 					},
 				},
 			},
@@ -250,614 +361,307 @@ func main() {
 }
 
 func anonymousSenderMode(context *cli.Context) error {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	start := time.Now()
-	senderNum := 0
 	log.Info("Anonymous Sender Mode")
-	emlFilePathList := utils.GetEmlFilePath(context.String("dir"))
-	log.Info("获取到的eml文件数量：" + strconv.Itoa(len(emlFilePathList)) + "封")
-	maxThreatCount := context.Int("thread")
-	accountConfig := context.String("accountConfig")
-	accountInfo := []utils.Account{}
-	accountIndex := 0
-	if accountConfig != "" {
-		log.Info("账户信息文件为：" + accountConfig)
-		// 读取账户信息文件
-		accountInfo = utils.ReadAccountConfig(accountConfig)
-		log.Info("账户信息为：", accountInfo)
-	}
-	// results := make(chan string, len(emlFilePathList))
-	var wg sync.WaitGroup
-	wg.Add(len(emlFilePathList))
-	workerPool := make(chan struct{}, maxThreatCount)
-	mailServer := context.String("server") + ":" + strconv.Itoa(context.Int("port"))
-	sleepUnit := TIME_UNIT[context.String("sleepUnit")]
-	var timeList []time.Duration
-	// 判断是否设置了时间阈值
-	log.Info("设置的时间阈值为：", context.Int("timeThreshold"))
-	if context.Int("timeThreshold") > 0 {
-		log.Info("设置了时间阈值，将在设定时间到达后退出程序")
-		timer := time.NewTimer(time.Duration(context.Int("timeThreshold")) * time.Minute)
-		// 创建一个数组用于保存时间戳
-		// 遍历eml文件列表
-		for _, emlFilePath := range emlFilePathList {
-			select {
-			case <-timer.C:
-				log.Info("发送邮件设定时间到达，程序退出")
-				goto END
-			case <-sigChan:
-				elapsed := time.Since(start)
-				log.Info("程序退出")
-				log.Info("开始发送邮件时间：", start.Format("2006-01-02 15:04:05"))
-				log.Info("发送邮件总耗时：", elapsed)
-				log.Infof("发送邮件总数量：%s 封,读取到邮件总数为：%s", strconv.Itoa(senderNum), strconv.Itoa(len(emlFilePathList)))
-				return nil
-			default:
-				senderNum++
-				log.Infof("发送邮件：%s,第%s封", emlFilePath, strconv.Itoa(senderNum))
-				SleepTime := context.Int("sleep")
-				time.Sleep(time.Duration(SleepTime) * sleepUnit)
-				workerPool <- struct{}{}
-				go func(emlFilePath string) {
-					// 读取eml文件转为字节
-					defer func() {
-						<-workerPool
-						wg.Done()
-					}()
-					defer func() {
-						if err := recover(); err != nil {
-							log.Error(err)
-						}
-					}()
-					emlContent := utils.StringToBytes(utils.ReadEml(emlFilePath))
-					// 获取现在的时间
-					now := time.Now()
-					// 发送邮件
-					tlsConfig := &tls.Config{
-						InsecureSkipVerify: true,
-						ServerName:         context.String("server"),
-					}
-					var conn net.Conn
-					var err error
-					if context.Int("port") == 25 {
-						conn, err = net.Dial("tcp", mailServer)
-						if err != nil {
-							log.Println(err)
-							return
-						}
-					} else {
-						conn, err = tls.Dial("tcp", mailServer, tlsConfig)
-						if err != nil {
-							log.Println(err)
-							return
-						}
-					}
-					defer conn.Close()
-					client, err := smtp.NewClient(conn, context.String("server"))
-					if err != nil {
-						log.Println(err)
-						return
-					}
-					//if err = client.Auth(auth); err != nil {
-					//	log.Printf("Auth err:%s", err)
-					//	return
-					//}
-					if accountConfig != "" {
-						log.Infof("发送邮件的账户为：%s", accountInfo)
-						if accountIndex >= len(accountInfo) {
-							accountIndex = 0
-						}
-						emailAddr := accountInfo[accountIndex].Username
-						log.Infof("发送邮件的账户为：%s", emailAddr)
-						if err := client.Mail(emailAddr); err != nil {
-							log.Printf("Mail err:%s", err)
-						}
-						accountIndex++
-					} else {
-						if err := client.Mail(context.String("from")); err != nil {
-							log.Printf("Mail err:%s", err)
-						}
-					}
-
-					if err := client.Rcpt(context.String("to")); err != nil {
-						log.Printf("rcpt err:%s", err)
-					}
-
-					writer, err := client.Data() // 获取写入器，用于写入邮件内容
-					if err != nil {
-						log.Printf("data err:%s", err)
-					}
-
-					_, err = writer.Write(emlContent) // 写入邮件内容
-					if err != nil {
-						log.Printf("write err:%s", err)
-					}
+	src, err := newSource(context)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	return runEngine(context, src, false)
+}
 
-					if err := writer.Close(); err != nil { // 关闭写入器
-						log.Printf("close err:%s", err)
-					}
-					finishTime := time.Now()
-					duration := finishTime.Sub(now)
-					log.Infof("发送邮件：%s,耗时：%s", emlFilePath, duration)
-					log.Info("发送邮件耗时：", duration)
-					timeList = append(timeList, duration)
-					// 计算发送邮件消耗的时间
-					// results <- emlFilePath + " done"
-				}(emlFilePath)
+func loginSenderMode(context *cli.Context) error {
+	log.Info("Login Sender Mode")
+	src, err := newSource(context)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	return runEngine(context, src, true)
+}
 
-			}
+func replaySenderMode(context *cli.Context) error {
+	log.Info("Replay Sender Mode")
+	src, err := newSource(context)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	return runEngine(context, src, false)
+}
 
-		}
-		wg.Wait()
+func exportMode(context *cli.Context) error {
+	log.Info("Export Mode")
+	out, tarName := context.String("out"), context.String("tar")
+	if out != "" && tarName != "" {
+		err := errors.New("--out和--tar只能设置一个")
+		log.Error(err)
+		return err
+	}
+	if out == "" && tarName == "" {
+		err := errors.New("必须设置--out或--tar")
+		log.Error(err)
+		return err
+	}
+	// 先打开邮件来源，来源无法打开时不会留下空的导出目录或归档
+	src, err := newSource(context)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	var exporter utils.Exporter
+	if out != "" {
+		exporter, err = utils.NewDirExporter(out)
 	} else {
-		log.Info("未设置时间阈值，将一直发送邮件,直到发送完毕")
-		for _, emlFilePath := range emlFilePathList {
-			select {
-			case <-sigChan:
-				elapsed := time.Since(start)
-				log.Info("程序退出")
-				log.Info("开始发送邮件时间：", start.Format("2006-01-02 15:04:05"))
-				log.Info("发送邮件总耗时：", elapsed)
-				log.Infof("发送邮件总数量：%s 封,读取到邮件总数为：%s", strconv.Itoa(senderNum), strconv.Itoa(len(emlFilePathList)))
-				return nil
-			default:
-				senderNum++
-				log.Infof("发送邮件：%s,第%s封", emlFilePath, strconv.Itoa(senderNum))
-				SleepTime := context.Int("sleep")
-				time.Sleep(time.Duration(SleepTime) * sleepUnit)
-				workerPool <- struct{}{}
-				go func(emlFilePath string) {
-					// 读取eml文件转为字节
-					defer func() {
-						<-workerPool
-						wg.Done()
-					}()
-					defer func() {
-						if err := recover(); err != nil {
-							log.Error(err)
-						}
-					}()
-					emlContent := utils.StringToBytes(utils.ReadEml(emlFilePath))
-					// 获取现在的时间
-					now := time.Now()
-					// 发送邮件
-					tlsConfig := &tls.Config{
-						InsecureSkipVerify: true,
-						ServerName:         context.String("server"),
-					}
-					var conn net.Conn
-					var err error
-					if context.Int("port") == 25 {
-						conn, err = net.Dial("tcp", mailServer)
-						if err != nil {
-							log.Println(err)
-							return
-						}
-					} else {
-						conn, err = tls.Dial("tcp", mailServer, tlsConfig)
-						if err != nil {
-							log.Println(err)
-							return
-						}
-					}
-					defer conn.Close()
-					client, err := smtp.NewClient(conn, context.String("server"))
-					if err != nil {
-						log.Println(err)
-						return
-					}
-					//if err = client.Auth(auth); err != nil {
-					//	log.Printf("Auth err:%s", err)
-					//	return
-					//}
-					if accountConfig != "" {
-						if accountIndex >= len(accountInfo) {
-							accountIndex = 0
-						}
-						emailAddr := accountInfo[accountIndex].Username
-						log.Infof("发送邮件的账户为：%s", emailAddr)
-						if err := client.Mail(emailAddr); err != nil {
-							log.Printf("Mail err:%s", err)
-						}
-						accountIndex++
-					} else {
-						if err := client.Mail(context.String("from")); err != nil {
-							log.Printf("Mail err:%s", err)
-						}
-					}
-
-					if err := client.Rcpt(context.String("to")); err != nil {
-						log.Printf("rcpt err:%s", err)
-					}
-
-					writer, err := client.Data() // 获取写入器，用于写入邮件内容
-					if err != nil {
-						log.Printf("data err:%s", err)
-					}
-
-					_, err = writer.Write(emlContent) // 写入邮件内容
-					if err != nil {
-						log.Printf("write err:%s", err)
-					}
-
-					if err := writer.Close(); err != nil { // 关闭写入器
-						log.Printf("close err:%s", err)
-					}
-					finishTime := time.Now()
-					duration := finishTime.Sub(now)
-					// log.Infof("发送邮件：%s,耗时：%s", emlFilePath, duration)
-					// log.Info("发送邮件耗时：", duration)
-					timeList = append(timeList, duration)
-					// 计算发送邮件消耗的时间
-					// results <- emlFilePath + " done"
-				}(emlFilePath)
-
+		exporter, err = utils.NewTarExporter(tarName)
+	}
+	if err != nil {
+		src.Close()
+		log.Error(err)
+		return err
+	}
+	defer src.Close()
+	ctx, stop := signal.NotifyContext(context.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	start := time.Now()
+	exported, failed, size := 0, 0, 0
+	for ctx.Err() == nil {
+		msg, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if msg == nil {
+				log.Error("读取邮件来源失败：", err)
+				break
 			}
-
+			failed++
+			log.Errorf("读取邮件失败：%s,错误：%s", msg.Path, err)
+			continue
 		}
-		wg.Wait()
-	}
-END:
-	// close(results)
-	elapsed := time.Since(start)
-	// 计算发件的平均时间
-	var sum time.Duration
-	for _, v := range timeList {
-		sum += v
-	}
-	avg := sum / time.Duration(len(timeList))
-	log.Info("平均发送邮件耗时：", avg)
-	// 获取最大的发件时间
-	var max time.Duration
-	for _, v := range timeList {
-		if v > max {
-			max = v
+		// 写入失败时导出结果已经不完整，停止导出
+		if err := exporter.Export(msg); err != nil {
+			log.Errorf("导出邮件失败：%s,错误：%s,停止导出", msg.Path, err)
+			exporter.Close()
+			return err
 		}
+		exported++
+		size += len(msg.Content)
+		log.Infof("导出邮件：%s,第%d封,大小：%d", msg.Path, exported, len(msg.Content))
+	}
+	if err := exporter.Close(); err != nil {
+		log.Error(err)
+		return err
 	}
-	log.Info("最大发送邮件耗时：", max)
-	log.Info("开始发送邮件时间：", start.Format("2006-01-02 15:04:05"))
-	log.Info("发送邮件总耗时：", elapsed)
-	log.Infof("发送邮件总数量：%s 封,读取到邮件总数为：%s", strconv.Itoa(senderNum), strconv.Itoa(len(emlFilePathList)))
+	log.Infof("导出邮件总数量：%d 封,失败：%d 封,总大小：%d 字节,耗时：%s", exported, failed, size, time.Since(start))
 	return nil
 }
 
-func loginSenderMode(context *cli.Context) error {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	start := time.Now()
-	senderNum := 0
-	emlFilePathList := utils.GetEmlFilePath(context.String("dir"))
-	log.Info("获取到的eml文件数量：" + strconv.Itoa(len(emlFilePathList)) + "封")
-	maxThreatCount := context.Int("thread")
-	results := make(chan string, len(emlFilePathList))
-	var wg sync.WaitGroup
-	wg.Add(len(emlFilePathList))
-	workerPool := make(chan struct{}, maxThreatCount)
-	sleepUnit := TIME_UNIT[context.String("sleepUnit")]
-	var timeList []time.Duration
-	accountConfig := context.String("accountConfig")
-	accountInfo := []utils.Account{}
-	accountIndex := 0
-	if accountConfig != "" {
-		log.Info("账户信息文件为：" + accountConfig)
-		// 读取账户信息文件
-		accountInfo = utils.ReadAccountConfig(accountConfig)
-		log.Info("账户信息为：", accountInfo)
-	}
-	// 遍历eml文件列表
-	if context.Int("timeThreshold") > 0 {
-		log.Info("设置了时间阈值，将在设定时间到达后退出程序")
-		timer := time.NewTimer(time.Duration(context.Int("timeThreshold")) * time.Minute)
-		for _, emlFilePath := range emlFilePathList {
-			select {
-			case <-sigChan:
-				elapsed := time.Since(start)
-				log.Info("程序退出")
-				log.Info("开始发送邮件时间：", start.Format("2006-01-02 15:04:05"))
-				log.Info("发送邮件总耗时：", elapsed)
-				log.Infof("发送邮件总数量：%s 封", strconv.Itoa(senderNum))
-				return nil
-			case <-timer.C:
-				log.Info("发送邮件设定时间到达，程序退出")
-				goto END
-			default:
-				senderNum++
-				log.Infof("发送邮件：%s,第%s封", emlFilePath, strconv.Itoa(senderNum))
-				SleepTime := context.Int("sleep")
-				time.Sleep(time.Duration(SleepTime) * sleepUnit)
-				workerPool <- struct{}{}
-				go func(emlFilePath string) {
-					defer func() {
-						emailAddr := context.String("from")
-						passWord := context.String("password")
-						if accountConfig != "" {
-							if accountIndex >= len(accountInfo) {
-								accountIndex = 0
-							}
-							emailAddr = accountInfo[accountIndex].Username
-							passWord = accountInfo[accountIndex].Password
-							accountIndex++
-						}
-						auth := smtp.PlainAuth("", emailAddr, passWord, context.String("server"))
-						// 读取eml文件转为字节
-						mailServer := context.String("server") + ":" + strconv.Itoa(context.Int("port"))
-						emlContent := utils.StringToBytes(utils.ReadEml(emlFilePath))
-						// 跳过tls证书验证
-						now := time.Now()
-						tlsConfig := &tls.Config{
-							InsecureSkipVerify: true,
-							ServerName:         context.String("server"),
-						}
-						var conn net.Conn
-						var err error
-						if context.Int("port") == 25 {
-							conn, err = net.Dial("tcp", mailServer)
-							if err != nil {
-								log.Println(err)
-								return
-							}
-						} else {
-							conn, err = tls.Dial("tcp", mailServer, tlsConfig)
-							if err != nil {
-								log.Println(err)
-								return
-							}
-						}
-						defer conn.Close()
-						client, err := smtp.NewClient(conn, context.String("server"))
-						if err != nil {
-							log.Println(err)
-							return
-						}
-						if err = client.Auth(auth); err != nil {
-							log.Fatalf("Auth err:%s", err)
-							return
-						}
-						if err := client.Mail(emailAddr); err != nil {
-							log.Fatalf("Mail err:%s", err)
-						}
-
-						if err := client.Rcpt(context.String("to")); err != nil {
-							log.Fatalf("rcpt err:%s", err)
-						}
-
-						writer, err := client.Data() // 获取写入器，用于写入邮件内容
-						if err != nil {
-							log.Printf("data err:%s", err)
-						}
-
-						_, err = writer.Write(emlContent) // 写入邮件内容
-						if err != nil {
-							log.Printf("write err:%s", err)
-						}
-
-						if err := writer.Close(); err != nil { // 关闭写入器
-							log.Printf("close err:%s", err)
-						}
+func reportMode(context *cli.Context) error {
+	log.Info("Report Mode")
+	in := context.String("in")
+	if in == "" {
+		err := errors.New("必须设置--in")
+		log.Error(err)
+		return err
+	}
+	records, err := sender.ReadRecords(in)
+	if err != nil {
+		log.Error("读取结果报告失败：", err)
+		return err
+	}
+	out := context.String("out")
+	if out == "" {
+		out = strings.TrimSuffix(in, filepath.Ext(in)) + ".html"
+	}
+	title := context.String("title")
+	if title == "" {
+		title = "发送报告 " + filepath.Base(in)
+	}
+	file, err := os.Create(out)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	err = sender.WriteHTMLReport(file, title, records, context.Duration("interval"))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Error("生成HTML报告失败：", err)
+		return err
+	}
+	log.Infof("生成HTML报告：%s,邮件数：%d", out, len(records))
+	return nil
+}
 
-						// 发送邮件
-						// err := smtp.SendMail(mailServer, auth, context.String("from"), []string{context.String("to")}, emlContent)
-						if err != nil {
-							<-workerPool
-							wg.Done()
-							log.Error(err)
-						}
-						<-workerPool
-						wg.Done()
-						finishTime := time.Now()
-						duration := finishTime.Sub(now)
-						log.Infof("发送邮件：%s,耗时：%s", emlFilePath, duration)
-						log.Info("发送邮件耗时：", duration)
-						timeList = append(timeList, duration)
-					}()
-					results <- emlFilePath + " done"
-				}(emlFilePath)
-			}
+// serveMetrics 在 addr 上提供 /metrics 接口，返回的服务器地址为实际监听的地址
+func serveMetrics(addr string, metrics *sender.Metrics) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &http.Server{Addr: ln.Addr().String(), Handler: mux}
+	go func() {
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			log.Error("指标服务退出：", err)
 		}
-		wg.Wait()
-	} else {
-		log.Info("未设置时间阈值，将一直发送邮件,直到发送完毕")
-		for _, emlFilePath := range emlFilePathList {
-			select {
-			case <-sigChan:
-				elapsed := time.Since(start)
-				log.Info("程序退出")
-				log.Info("开始发送邮件时间：", start.Format("2006-01-02 15:04:05"))
-				log.Info("发送邮件总耗时：", elapsed)
-				log.Infof("发送邮件总数量：%s 封", strconv.Itoa(senderNum))
-				return nil
-			default:
-				senderNum++
-				log.Infof("发送邮件：%s,第%s封", emlFilePath, strconv.Itoa(senderNum))
-				SleepTime := context.Int("sleep")
-				time.Sleep(time.Duration(SleepTime) * sleepUnit)
-				workerPool <- struct{}{}
-				go func(emlFilePath string) {
-					defer func() {
-						emailAddr := context.String("from")
-						passWord := context.String("password")
-						if accountConfig != "" {
-							if accountIndex >= len(accountInfo) {
-								accountIndex = 0
-							}
-							emailAddr = accountInfo[accountIndex].Username
-							passWord = accountInfo[accountIndex].Password
-							accountIndex++
-						}
-						auth := smtp.PlainAuth("", emailAddr, passWord, context.String("server"))
-						// 读取eml文件转为字节
-						mailServer := context.String("server") + ":" + strconv.Itoa(context.Int("port"))
-						emlContent := utils.StringToBytes(utils.ReadEml(emlFilePath))
-						// 跳过tls证书验证
-						now := time.Now()
-						tlsConfig := &tls.Config{
-							InsecureSkipVerify: true,
-							ServerName:         context.String("server"),
-						}
-						var conn net.Conn
-						var err error
-						if context.Int("port") == 25 {
-							conn, err = net.Dial("tcp", mailServer)
-							if err != nil {
-								log.Error(err)
-								return
-							}
-						} else {
-							conn, err = tls.Dial("tcp", mailServer, tlsConfig)
-							if err != nil {
-								log.Error(err)
-								return
-							}
-						}
-
-						defer conn.Close()
-						client, err := smtp.NewClient(conn, context.String("server"))
-						if err != nil {
-							log.Error(err)
-							return
-						}
-						// 如果报错需要注释 Auth方法中的代码内容
-						// if !server.TLS && !isLocalhost(server.Name) {
-						// 	return "", nil, errors.New("unencrypted connection")
-						// }
-						if err = client.Auth(auth); err != nil {
-							log.Fatalf("Auth err:%s", err)
-						}
-						if err := client.Mail(emailAddr); err != nil {
-							log.Printf("Mail err:%s", err)
-						}
-
-						if err := client.Rcpt(context.String("to")); err != nil {
-							log.Printf("rcpt err:%s", err)
-						}
-
-						writer, err := client.Data() // 获取写入器，用于写入邮件内容
-						if err != nil {
-							log.Printf("data err:%s", err)
-						}
-
-						_, err = writer.Write(emlContent) // 写入邮件内容
-						if err != nil {
-							log.Printf("write err:%s", err)
-						}
-
-						if err := writer.Close(); err != nil { // 关闭写入器
-							log.Printf("close err:%s", err)
-						}
+	}()
+	return server, nil
+}
 
-						// 发送邮件
-						// err := smtp.SendMail(mailServer, auth, context.String("from"), []string{context.String("to")}, emlContent)
-						if err != nil {
-							<-workerPool
-							wg.Done()
-							log.Error(err)
-						}
-						<-workerPool
-						wg.Done()
-						results <- emlFilePath + " done"
-						finishTime := time.Now()
-						duration := finishTime.Sub(now)
-						log.Infof("发送邮件：%s,耗时：%s", emlFilePath, duration)
-						log.Info("发送邮件耗时：", duration)
-						timeList = append(timeList, duration)
-					}()
-				}(emlFilePath)
-			}
+// runEngine 根据命令行参数创建发件引擎，发送 src 中的所有邮件并输出汇总信息
+func runEngine(context *cli.Context, src utils.Source, login bool) error {
+	defer src.Close()
+	tlsConfig, err := sender.NewTLSConfig(sender.TLSOptions{
+		Verify:     context.Bool("tlsVerify"),
+		CAFile:     context.String("caFile"),
+		ServerName: context.String("sni"),
+		MinVersion: context.String("tlsMinVersion"),
+		MaxVersion: context.String("tlsMaxVersion"),
+		CertFile:   context.String("clientCert"),
+		KeyFile:    context.String("clientKey"),
+	}, context.String("server"))
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Context, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	cfg := sender.Config{
+		Server:          context.String("server"),
+		Port:            context.Int("port"),
+		TLSMode:         context.String("tls"),
+		TLSConfig:       tlsConfig,
+		Thread:          context.Int("thread"),
+		Sleep:           time.Duration(context.Int("sleep")) * TIME_UNIT[context.String("sleepUnit")],
+		TimeThreshold:   time.Duration(context.Int("timeThreshold")) * time.Minute,
+		Faithful:        context.Bool("faithful"),
+		Speed:           context.Float64("speed"),
+		MaxGap:          context.Duration("maxGap"),
+		Rate:            context.Float64("rate"),
+		Burst:           context.Int("burst"),
+		ByteRate:        context.Float64("byteRate"),
+		ByteBurst:       context.Int("byteBurst"),
+		OpenModel:       context.Bool("openModel"),
+		Arrival:         context.String("arrival"),
+		MaxInFlight:     context.Int("maxInFlight"),
+		From:            context.String("from"),
+		To:              context.String("to"),
+		HeaderEnvelope:  context.Bool("envelopeFromHeaders"),
+		XClient:         context.Bool("xclient"),
+		Login:           login,
+		Password:        context.String("password"),
+		Pipelining:      context.Bool("pipelining"),
+		Chunking:        context.Bool("chunking"),
+		ChunkSize:       context.Int("chunkSize"),
+		MessagesPerConn: context.Int("messagesPerConn"),
+		IdleTimeout:     context.Duration("idleTimeout"),
+	}
+	if accountConfig := context.String("accountConfig"); accountConfig != "" {
+		log.Info("账户信息文件为：" + accountConfig)
+		// 读取账户信息文件
+		cfg.Accounts = utils.ReadAccountConfig(accountConfig)
+		log.Info("账户信息为：", cfg.Accounts)
+	}
+	if rcptFile := context.String("rcptFile"); rcptFile != "" {
+		if cfg.Recipients, err = utils.ReadRecipientFile(rcptFile); err != nil {
+			log.Error(err)
+			return err
 		}
-		wg.Wait()
-	}
-END:
-	// close(results)
-	close(results)
-	elapsed := time.Since(start)
-	// 计算发件的平均时间
-	var sum time.Duration
-	for _, v := range timeList {
-		sum += v
-	}
-	avg := sum / time.Duration(len(timeList))
-	log.Info("平均发送邮件耗时：", avg)
-	// 获取最大的发件时间
-	var max time.Duration
-	for _, v := range timeList {
-		if v > max {
-			max = v
+		log.Infof("收件人列表文件为：%s,收件人数量：%d", rcptFile, len(cfg.Recipients))
+		cfg.RcptPerMessage = context.Int("rcptPerMessage")
+		cfg.RcptMode = context.String("rcptMode")
+	}
+	log.Info("设置的时间阈值为：", context.Int("timeThreshold"))
+	if cfg.Faithful {
+		if cfg.Speed <= 0 {
+			err = errors.New("speed必须大于0")
+			log.Error(err)
+			return err
 		}
+		log.Infof("按原始到达间隔派发邮件,倍速：%g,最大间隔：%s", cfg.Speed, cfg.MaxGap)
 	}
-	log.Info("开始发送邮件时间：", start.Format("2006-01-02 15:04:05"))
-	log.Info("发送邮件总耗时：", elapsed)
-	log.Infof("发送邮件总数量：%s 封,读取到邮件总数为：%s", strconv.Itoa(senderNum), strconv.Itoa(len(emlFilePathList)))
-	return nil
-}
-
-func replaySenderMode(context *cli.Context) error {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	start := time.Now()
-	senderNum := 0
-	log.Info("Replay Sender Mode")
-	// 从clickhouse中读取eml文件路径
-	emlFilePathList := utils.GetClickHouseEmlFilePath(context.String("clickhouse"), context.Int("ckPort"), context.String("ckUser"), context.String("ckPassword"), context.String("ckDatabase"), context.String("startTime"), context.String("endTime"))
-	log.Info("获取到的eml文件数量：" + strconv.Itoa(len(emlFilePathList)) + "封")
-	// 从minio中读取eml文件内容
-	// 获取minio client
-	minioClient, err := minio.New(context.String("minio")+":"+strconv.Itoa(context.Int("minioPort")), &minio.Options{
-		Creds:  credentials.NewStaticV4(context.String("minioUser"), context.String("minioPassword"), ""),
-		Secure: false,
-	})
+	if spec := context.String("profile"); spec != "" {
+		if cfg.Profile, err = sender.ParseProfile(spec); err != nil {
+			log.Error(err)
+			return err
+		}
+		log.Infof("负载曲线：%s,总时长：%s", spec, cfg.Profile.Duration())
+		// 负载曲线代替rate
+		cfg.Rate = 0
+	}
+	if cfg.OpenModel {
+		log.Infof("按开放模型发送,到达间隔分布：%s,进行中的邮件数上限：%d", cfg.Arrival, cfg.MaxInFlight)
+	}
+	if cfg.Rate > 0 || cfg.ByteRate > 0 {
+		log.Infof("限速：%g 封/秒,突发：%d 封,%g 字节/秒", cfg.Rate, cfg.Burst, cfg.ByteRate)
+	}
+	if addr := context.String("metricsAddr"); addr != "" {
+		cfg.Metrics = sender.NewMetrics()
+		server, err := serveMetrics(addr, cfg.Metrics)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		defer server.Close()
+		log.Infof("指标地址：http://%s/metrics", server.Addr)
+	}
+	engine, err := sender.NewEngine(cfg)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
-	maxThreatCount := context.Int("thread")
-	results := make(chan string, len(emlFilePathList))
-	var wg sync.WaitGroup
-	wg.Add(len(emlFilePathList))
-	workerPool := make(chan struct{}, maxThreatCount)
-
-	// 遍历eml文件列表
-	for _, emlFilePath := range emlFilePathList {
-		select {
-		case <-sigChan:
-			elapsed := time.Since(start)
-			log.Info("程序退出")
-			log.Info("开始发送邮件时间：", start.Format("2006-01-02 15:04:05"))
-			log.Info("发送邮件总耗时：", elapsed)
-			log.Infof("发送邮件总数量：%s 封,读取到邮件总数为：%s", strconv.Itoa(senderNum), strconv.Itoa(len(emlFilePathList)))
-			return nil
-		default:
-			senderNum++
-			log.Infof("发送邮件：%s,第%s封", emlFilePath, strconv.Itoa(senderNum))
-			SleepTime := context.Int("sleep")
-			time.Sleep(time.Duration(SleepTime) * time.Second)
-			workerPool <- struct{}{}
-			go func(emlFilePath string) {
-				defer func() {
-					// 读取eml文件转为字节
-					emlContent := utils.GetEmlFileForMinio(emlFilePath, minioClient)
-					// 输出读取到的eml文件内容
-					//log.Info(emlContent)
-					// 发送邮件
-					err := smtp.SendMail(context.String("server")+":"+strconv.Itoa(context.Int("port")), nil, context.String("from"), []string{context.String("to")}, emlContent)
-					if err != nil {
-						<-workerPool
-						wg.Done()
-						log.Error(err)
-					}
-					<-workerPool
-					wg.Done()
-				}()
-				results <- emlFilePath + " done"
-			}(emlFilePath)
+	summary := sender.NewSummary()
+	summary.SetTarget(cfg.Rate, cfg.ByteRate)
+	summary.SetProfile(cfg.Profile)
+	summary.SetInterval(context.Duration("summaryInterval"))
+	if cfg.OpenModel {
+		summary.SetOpenModel()
+	}
+	var reports []*sender.ReportWriter
+	// 后面的报告文件创建失败时也关闭已经创建的报告文件
+	defer func() {
+		for _, report := range reports {
+			if err := report.Close(summary.Report()); err != nil {
+				log.Error("写入结果报告失败：", err)
+			}
 		}
+	}()
+	for _, path := range context.StringSlice("report") {
+		report, err := sender.NewReportWriter(path)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		log.Info("结果报告文件为：", path)
+		reports = append(reports, report)
 	}
-	wg.Wait()
-	close(results)
-
-	elapsed := time.Since(start)
-	log.Info("开始发送邮件时间：", start.Format("2006-01-02 15:04:05"))
-	log.Info("发送邮件总耗时：", elapsed)
-	log.Infof("发送邮件总数量：%s 封,读取到邮件总数为：%s", strconv.Itoa(senderNum), strconv.Itoa(len(emlFilePathList)))
+	senderNum := 0
+	for res := range engine.Run(ctx, src) {
+		senderNum++
+		summary.Add(res)
+		for _, report := range reports {
+			if err := report.Write(res); err != nil {
+				log.Error("写入结果报告失败：", err)
+			}
+		}
+		for _, rcpt := range res.Rcpts {
+			if !rcpt.Accepted() {
+				log.Warnf("收件人被拒绝：%s,邮件：%s,响应：%d %s", rcpt.Addr, res.Path, rcpt.Code, rcpt.Msg)
+			}
+		}
+		if res.OK() {
+			log.Infof("发送邮件：%s,第%s封,发件人：%s,TLS：%s %s,耗时：%s,队列ID：%s", res.Path, strconv.Itoa(senderNum), res.From, res.TLSVersion, res.TLSCipher, res.Duration, res.Reply.QueueID)
+		} else {
+			log.Errorf("发送邮件失败：%s,第%s封,阶段：%s,错误：%s", res.Path, strconv.Itoa(senderNum), res.Stage, res.Err)
+		}
+	}
+	if ctx.Err() != nil {
+		log.Info("程序退出")
+	}
+	summary.Log()
 	return nil
 }
@@ -0,0 +1,24 @@
+package sender
+
+import (
+	"errors"
+	"net/smtp"
+)
+
+// plainAuth 与 smtp.PlainAuth 相同，但不要求连接必须加密，
+// 压测环境中经常需要在明文连接上登录
+type plainAuth struct {
+	identity, username, password string
+}
+
+func (a *plainAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	resp := []byte(a.identity + "\x00" + a.username + "\x00" + a.password)
+	return "PLAIN", resp, nil
+}
+
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("unexpected server challenge")
+	}
+	return nil, nil
+}
@@ -0,0 +1,150 @@
+package sender
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 图表的尺寸和边距，单位为像素
+const (
+	chartWidth  = 960
+	chartHeight = 280
+	chartLeft   = 64
+	chartRight  = 16
+	chartTop    = 32
+	chartBottom = 32
+	barHeight   = 22
+	barLabel    = 160
+)
+
+// chartSeries 折线图中的一条折线，值为 NaN 的点表示没有数据，折线在此处断开
+type chartSeries struct {
+	Name   string
+	Color  string
+	Values []float64
+}
+
+// niceCeil 返回不小于 v 的 1、2、5 乘以10的幂的数，作为坐标轴的最大值
+func niceCeil(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	exp := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, f := range []float64{1, 2, 5, 10} {
+		if f*exp >= v {
+			return f * exp
+		}
+	}
+	return 10 * exp
+}
+
+// formatValue 格式化坐标轴和数据标签上的数值
+func formatValue(v float64) string {
+	if v == math.Trunc(v) || v >= 100 {
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strings.TrimRight(strings.TrimRight(strconv.FormatFloat(v, 'f', 2, 64), "0"), ".")
+}
+
+// lineChart 生成折线图，labels 为横轴每个点的标签，unit 为纵轴的单位
+func lineChart(labels []string, unit string, series []chartSeries) template.HTML {
+	var max float64
+	for _, s := range series {
+		for _, v := range s.Values {
+			if !math.IsNaN(v) && v > max {
+				max = v
+			}
+		}
+	}
+	top := niceCeil(max)
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	plotHeight := float64(chartHeight - chartTop - chartBottom)
+	n := len(labels)
+	x := func(i int) float64 {
+		if n <= 1 {
+			return chartLeft + plotWidth/2
+		}
+		return chartLeft + plotWidth*float64(i)/float64(n-1)
+	}
+	y := func(v float64) float64 {
+		return chartTop + plotHeight*(1-v/top)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" class="chart">`, chartWidth, chartHeight)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" class="unit">%s</text>`, chartLeft, chartTop-16, html.EscapeString(unit))
+	for i := 0; i <= 4; i++ {
+		v := top * float64(i) / 4
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" class="grid"/>`, chartLeft, y(v), chartWidth-chartRight, y(v))
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" class="axis" text-anchor="end">%s</text>`, chartLeft-6, y(v)+4, formatValue(v))
+	}
+	step := n/8 + 1
+	for i := 0; i < n; i += step {
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" class="axis" text-anchor="middle">%s</text>`,
+			x(i), chartHeight-chartBottom+18, html.EscapeString(labels[i]))
+	}
+	legend := chartLeft + 120
+	for _, s := range series {
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="12" height="12" fill="%s"/>`, legend, chartTop-26, s.Color)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" class="legend">%s</text>`, legend+16, chartTop-16, html.EscapeString(s.Name))
+		legend += 24 + 8*len(s.Name)
+	}
+	for _, s := range series {
+		var path strings.Builder
+		move := true
+		for i, v := range s.Values {
+			if math.IsNaN(v) {
+				move = true
+				continue
+			}
+			if move {
+				fmt.Fprintf(&path, "M%.1f %.1f", x(i), y(v))
+				move = false
+			} else {
+				fmt.Fprintf(&path, "L%.1f %.1f", x(i), y(v))
+			}
+			// 点较少时标出每个点，避免孤立的点看不到
+			if n <= 60 {
+				fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="2.5" fill="%s"/>`, x(i), y(v), s.Color)
+			}
+		}
+		if path.Len() > 0 {
+			fmt.Fprintf(&b, `<path d="%s" fill="none" stroke="%s" stroke-width="1.5"/>`, path.String(), s.Color)
+		}
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// barChart 生成横向柱状图，每个柱子右侧显示数值和占比
+func barChart(labels []string, values []float64, colors []string) template.HTML {
+	var max, total float64
+	for _, v := range values {
+		total += v
+		if v > max {
+			max = v
+		}
+	}
+	if max <= 0 {
+		max = 1
+	}
+	height := chartTop/2 + barHeight*len(labels) + 8
+	plotWidth := float64(chartWidth - barLabel - chartRight - 120)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" class="chart">`, chartWidth, height)
+	for i, label := range labels {
+		top := chartTop/2 + barHeight*i
+		width := plotWidth * values[i] / max
+		fmt.Fprintf(&b, `<text x="%d" y="%d" class="axis" text-anchor="end">%s</text>`, barLabel-8, top+15, html.EscapeString(label))
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%.1f" height="%d" fill="%s"/>`, barLabel, top+3, width, barHeight-6, colors[i])
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" class="axis">%s (%.1f%%)</text>`,
+			float64(barLabel)+width+6, top+15, formatValue(values[i]), values[i]/total*100)
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
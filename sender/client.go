@@ -0,0 +1,418 @@
+package sender
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// client SMTP客户端，与 net/smtp.Client 类似，但支持PIPELINING和CHUNKING
+type client struct {
+	conn net.Conn
+	text *textproto.Conn
+	// serverName 认证时用于 smtp.ServerInfo
+	serverName string
+	// ext EHLO响应中的扩展，键为大写的扩展名
+	ext map[string]string
+	// broken 为 true 表示会话状态未知，关闭时不再发送QUIT
+	broken bool
+	// last 最近读取的一个响应
+	last Reply
+	// pending 已写入但还没有读取响应的命令名，PIPELINING时可能有多个
+	pending []string
+	// replies 不为 nil 时按顺序记录读取到的每个响应
+	replies *[]Reply
+}
+
+const (
+	localName   = "localhost"
+	quitTimeout = 5 * time.Second
+)
+
+// newClient 读取服务器的欢迎信息，之后需要调用 hello 发送EHLO，
+// replies 不为 nil 时从欢迎信息开始记录服务器的响应
+func newClient(conn net.Conn, serverName string, replies *[]Reply) (*client, error) {
+	c := &client{conn: conn, text: textproto.NewConn(conn), serverName: serverName, replies: replies}
+	c.pending = append(c.pending, CommandConnect)
+	if _, _, err := c.read(220); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// hello 发送EHLO并解析扩展，服务器不支持EHLO时使用HELO
+func (c *client) hello() error {
+	c.ext = map[string]string{}
+	_, msg, err := c.cmd(250, "EHLO %s", localName)
+	if err != nil {
+		_, _, err = c.cmd(250, "HELO %s", localName)
+		return err
+	}
+	lines := strings.Split(msg, "\n")
+	for _, line := range lines[1:] {
+		name, args, _ := strings.Cut(line, " ")
+		c.ext[strings.ToUpper(name)] = args
+	}
+	return nil
+}
+
+// extension 判断服务器是否支持某个扩展
+func (c *client) extension(name string) (bool, string) {
+	args, ok := c.ext[strings.ToUpper(name)]
+	return ok, args
+}
+
+// cmd 发送一条命令并读取响应，命令的第一个单词作为响应对应的命令名
+func (c *client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	line := fmt.Sprintf(format, args...)
+	name, _, _ := strings.Cut(line, " ")
+	return c.namedCmd(strings.ToUpper(name), expectCode, line)
+}
+
+// namedCmd 发送一行内容并读取响应，响应对应的命令名为 name，
+// 用于AUTH的后续数据等不以命令名开头的行
+func (c *client) namedCmd(name string, expectCode int, line string) (int, string, error) {
+	if err := c.text.PrintfLine("%s", line); err != nil {
+		return 0, "", err
+	}
+	c.pending = append(c.pending, name)
+	return c.read(expectCode)
+}
+
+// read 读取一个响应，与 textproto.Conn.ReadResponse 相同，
+// 同时记录到 last 和 replies，对应的命令名从 pending 中依次取出
+func (c *client) read(expectCode int) (int, string, error) {
+	var name string
+	if len(c.pending) > 0 {
+		name, c.pending = c.pending[0], c.pending[1:]
+	}
+	code, msg, err := c.text.ReadResponse(expectCode)
+	if code != 0 {
+		c.last = newReply(code, msg)
+		c.last.Command = name
+		if c.replies != nil {
+			*c.replies = append(*c.replies, c.last)
+		}
+	}
+	if err != nil && !isSMTPError(err) {
+		// 连接出错后之后的响应无法与命令对应
+		c.pending = nil
+	}
+	return code, msg, err
+}
+
+// startTLS 发送STARTTLS并完成TLS握手，之后需要调用 hello 重新发送EHLO
+func (c *client) startTLS(config *tls.Config) error {
+	if _, _, err := c.cmd(220, "STARTTLS"); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, config)
+	c.conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		// 握手失败后连接处于未知状态，不能再以明文发送QUIT
+		c.broken = true
+		return err
+	}
+	c.conn.SetDeadline(time.Time{})
+	c.conn = tlsConn
+	c.text = textproto.NewConn(c.conn)
+	return nil
+}
+
+// xclient 发送XCLIENT设置客户端属性，服务器返回欢迎信息后重新发送EHLO
+func (c *client) xclient(attrs string) error {
+	if _, _, err := c.cmd(220, "XCLIENT %s", attrs); err != nil {
+		return err
+	}
+	return c.hello()
+}
+
+// tlsConnectionState 返回TLS连接状态，未使用TLS时 ok 为 false
+func (c *client) tlsConnectionState() (state tls.ConnectionState, ok bool) {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// auth 使用 smtp.Auth 进行认证
+func (c *client) auth(a smtp.Auth) error {
+	encoding := base64.StdEncoding
+	_, isTLS := c.tlsConnectionState()
+	_, mechs := c.extension("AUTH")
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: c.serverName, TLS: isTLS, Auth: strings.Fields(mechs)})
+	if err != nil {
+		c.namedCmd("AUTH", 501, "*")
+		return err
+	}
+	code, msg64, err := c.cmd(0, "%s", strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, encoding.EncodeToString(resp))))
+	for err == nil {
+		var msg []byte
+		switch code {
+		case 334:
+			msg, err = encoding.DecodeString(msg64)
+		case 235:
+			msg = []byte(msg64)
+		default:
+			err = &textproto.Error{Code: code, Msg: msg64}
+		}
+		if err == nil {
+			resp, err = a.Next(msg, code == 334)
+		}
+		if err != nil {
+			// 中止认证
+			c.namedCmd("AUTH", 501, "*")
+			break
+		}
+		if resp == nil {
+			break
+		}
+		code, msg64, err = c.namedCmd("AUTH", 0, encoding.EncodeToString(resp))
+	}
+	return err
+}
+
+// mailCmd 返回MAIL FROM命令
+func (c *client) mailCmd(from string) string {
+	cmd := "MAIL FROM:<" + from + ">"
+	if ok, _ := c.extension("8BITMIME"); ok {
+		cmd += " BODY=8BITMIME"
+	}
+	return cmd
+}
+
+// envelope 发送MAIL和RCPT，withData 为 true 时再发送DATA，
+// pipelining 为 true 时一次性写入所有命令后再依次读取响应。
+// 部分收件人被拒绝时继续发送，全部收件人被拒绝时返回错误
+func (c *client) envelope(from string, to []string, withData, pipelining bool, t *Timings) ([]RcptResult, Stage, error) {
+	if len(to) == 0 {
+		return nil, StageRcpt, errors.New("没有收件人")
+	}
+	if pipelining {
+		return c.pipelinedEnvelope(from, to, withData, t)
+	}
+	start := time.Now()
+	_, _, err := c.cmd(250, "%s", c.mailCmd(from))
+	t.Mail = time.Since(start)
+	if err != nil {
+		return nil, StageMail, err
+	}
+	start = time.Now()
+	rcpts := make([]RcptResult, len(to))
+	accepted := 0
+	var rcptErr error
+	for i, addr := range to {
+		code, msg, err := c.cmd(25, "RCPT TO:<%s>", addr)
+		rcpts[i] = RcptResult{Addr: addr, Code: code, Msg: msg}
+		if err != nil {
+			if !isSMTPError(err) {
+				t.Rcpt = time.Since(start)
+				return rcpts, StageRcpt, err
+			}
+			rcptErr = err
+			continue
+		}
+		accepted++
+	}
+	t.Rcpt = time.Since(start)
+	if accepted == 0 {
+		return rcpts, StageRcpt, rcptErr
+	}
+	if withData {
+		start = time.Now()
+		_, _, err := c.cmd(354, "DATA")
+		t.Data = time.Since(start)
+		if err != nil {
+			return rcpts, StageData, err
+		}
+	}
+	return rcpts, "", nil
+}
+
+// pipelinedEnvelope 一次性写入MAIL、RCPT和DATA命令，再依次读取响应
+// MAIL 的耗时从写入命令开始计算，RCPT 和 DATA 的耗时为读取到上一个响应之后等待该命令响应的时间
+func (c *client) pipelinedEnvelope(from string, to []string, withData bool, t *Timings) ([]RcptResult, Stage, error) {
+	start := time.Now()
+	c.text.W.WriteString(c.mailCmd(from) + "\r\n")
+	c.pending = append(c.pending, "MAIL")
+	for _, addr := range to {
+		c.text.W.WriteString("RCPT TO:<" + addr + ">\r\n")
+		c.pending = append(c.pending, "RCPT")
+	}
+	if withData {
+		c.text.W.WriteString("DATA\r\n")
+		c.pending = append(c.pending, "DATA")
+	}
+	if err := c.text.W.Flush(); err != nil {
+		c.pending = nil
+		return nil, StageMail, err
+	}
+	_, _, mailErr := c.read(250)
+	t.Mail = time.Since(start)
+	if mailErr != nil && !isSMTPError(mailErr) {
+		return nil, StageMail, mailErr
+	}
+	start = time.Now()
+	rcpts := make([]RcptResult, len(to))
+	accepted := 0
+	var rcptErr error
+	for i, addr := range to {
+		code, msg, err := c.read(25)
+		rcpts[i] = RcptResult{Addr: addr, Code: code, Msg: msg}
+		if err != nil {
+			if !isSMTPError(err) {
+				t.Rcpt = time.Since(start)
+				return rcpts, StageRcpt, err
+			}
+			rcptErr = err
+			continue
+		}
+		accepted++
+	}
+	t.Rcpt = time.Since(start)
+	if withData {
+		start = time.Now()
+		code, _, err := c.read(354)
+		t.Data = time.Since(start)
+		if err != nil && !isSMTPError(err) {
+			return rcpts, StageData, err
+		}
+		if code == 354 && (mailErr != nil || accepted == 0) {
+			// 服务器在之前的命令失败后仍然进入了DATA状态，无法安全地放弃本次邮件，由调用方关闭连接
+			if mailErr == nil {
+				mailErr = rcptErr
+			}
+			c.broken = true
+			return rcpts, StageData, fmt.Errorf("%w，服务器仍接受了DATA命令", mailErr)
+		}
+		if err != nil && mailErr == nil && accepted > 0 {
+			return rcpts, StageData, err
+		}
+	}
+	if mailErr != nil {
+		return rcpts, StageMail, mailErr
+	}
+	if accepted == 0 {
+		return rcpts, StageRcpt, rcptErr
+	}
+	return rcpts, "", nil
+}
+
+// isSMTPError 判断是否为服务器返回的错误响应，否则为连接错误
+func isSMTPError(err error) bool {
+	_, ok := err.(*textproto.Error)
+	return ok
+}
+
+// data 在DATA命令之后写入邮件内容并读取最终响应
+func (c *client) data(content []byte, t *Timings) error {
+	start := time.Now()
+	writer := c.text.DotWriter()
+	if _, err := writer.Write(content); err != nil {
+		writer.Close()
+		t.Data += time.Since(start)
+		return err
+	}
+	err := writer.Close()
+	t.Data += time.Since(start)
+	if err != nil {
+		return err
+	}
+	start = time.Now()
+	c.pending = append(c.pending, CommandDataEnd)
+	_, _, err = c.read(250)
+	t.Final = time.Since(start)
+	return err
+}
+
+// bdat 使用BDAT分块发送邮件内容，pipelining 为 true 时连续写入所有分块再读取响应
+func (c *client) bdat(content []byte, chunkSize int, pipelining bool, t *Timings) error {
+	// final 为最后一个分块写入完成的时间，之后等待的时间作为最终响应的耗时
+	start := time.Now()
+	var final time.Time
+	defer func() {
+		if final.IsZero() {
+			t.Data = time.Since(start)
+			return
+		}
+		t.Data, t.Final = final.Sub(start), time.Since(final)
+	}()
+	content = toCRLF(content)
+	if chunkSize <= 0 || chunkSize > len(content) {
+		chunkSize = len(content)
+	}
+	pending := 0
+	for offset := 0; ; offset += chunkSize {
+		end := offset + chunkSize
+		last := end >= len(content)
+		if last {
+			end = len(content)
+			fmt.Fprintf(c.text.W, "BDAT %d LAST\r\n", end-offset)
+		} else {
+			fmt.Fprintf(c.text.W, "BDAT %d\r\n", end-offset)
+		}
+		c.text.W.Write(content[offset:end])
+		c.pending = append(c.pending, "BDAT")
+		pending++
+		if pipelining && !last {
+			continue
+		}
+		if err := c.text.W.Flush(); err != nil {
+			c.pending = nil
+			return err
+		}
+		if last {
+			final = time.Now()
+		}
+		for ; pending > 0; pending-- {
+			if _, _, err := c.read(250); err != nil {
+				return err
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// toCRLF 将邮件内容中单独的LF转换为CRLF，BDAT不会像DATA那样转换换行符
+func toCRLF(content []byte) []byte {
+	if !bytes.Contains(content, []byte("\n")) {
+		return content
+	}
+	buf := make([]byte, 0, len(content)+bytes.Count(content, []byte("\n")))
+	for i, b := range content {
+		if b == '\n' && (i == 0 || content[i-1] != '\r') {
+			buf = append(buf, '\r')
+		}
+		buf = append(buf, b)
+	}
+	return buf
+}
+
+func (c *client) reset() error {
+	_, _, err := c.cmd(250, "RSET")
+	return err
+}
+
+// quit 发送QUIT，最多等待 quitTimeout
+func (c *client) quit() error {
+	if c.broken {
+		return nil
+	}
+	c.conn.SetDeadline(time.Now().Add(quitTimeout))
+	_, _, err := c.cmd(221, "QUIT")
+	return err
+}
+
+func (c *client) close() error {
+	return c.text.Close()
+}
@@ -0,0 +1,580 @@
+package sender
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/textproto"
+	"reflect"
+	"sendmail/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOptions 测试用SMTP服务器支持的扩展和行为
+type fakeOptions struct {
+	pipelining bool
+	chunking   bool
+	startTLS   bool
+	xclient    bool
+	// rejectRcpt 被拒绝的收件人
+	rejectRcpt string
+}
+
+// fakeMessage 测试服务器收到的一封邮件
+type fakeMessage struct {
+	from    string
+	to      []string
+	data    string
+	xclient string
+	auth    bool
+}
+
+// fakeServer 进程内的SMTP服务器，按收到的命令依次响应，不关心客户端是否使用了PIPELINING
+type fakeServer struct {
+	t        *testing.T
+	ln       net.Listener
+	opts     fakeOptions
+	tlsConf  *tls.Config
+	mu       sync.Mutex
+	messages []fakeMessage
+	queued   int
+}
+
+func newFakeServer(t *testing.T, opts fakeOptions) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{t: t, ln: ln, opts: opts, tlsConf: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeServer) received() []fakeMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMessage(nil), s.messages...)
+}
+
+func (s *fakeServer) queueID(prefix string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued++
+	return prefix + strconv.Itoa(s.queued)
+}
+
+func (s *fakeServer) deliver(msg fakeMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) {
+		text.PrintfLine(format, args...)
+	}
+	reply("220 fake ESMTP")
+	isTLS := false
+	var msg fakeMessage
+	var auth bool
+	var xclient string
+	var bdat strings.Builder
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			ext := []string{"fake", "8BITMIME", "AUTH PLAIN"}
+			if s.opts.pipelining {
+				ext = append(ext, "PIPELINING")
+			}
+			if s.opts.chunking {
+				ext = append(ext, "CHUNKING")
+			}
+			if s.opts.startTLS && !isTLS {
+				ext = append(ext, "STARTTLS")
+			}
+			if s.opts.xclient {
+				ext = append(ext, "XCLIENT ADDR NAME")
+			}
+			for i, e := range ext {
+				sep := "-"
+				if i == len(ext)-1 {
+					sep = " "
+				}
+				reply("250%s%s", sep, e)
+			}
+		case "HELO":
+			reply("250 fake")
+		case "STARTTLS":
+			reply("220 2.0.0 ready")
+			tlsConn := tls.Server(conn, s.tlsConf)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, isTLS = tlsConn, true
+			text = textproto.NewConn(conn)
+		case "AUTH":
+			auth = true
+			reply("235 2.7.0 authenticated")
+		case "XCLIENT":
+			xclient = args
+			// Postfix 在XCLIENT后重置会话，之前的认证失效
+			auth = false
+			reply("220 fake ESMTP")
+		case "MAIL":
+			msg = fakeMessage{from: strings.Trim(strings.Fields(strings.TrimPrefix(args, "FROM:"))[0], "<>"), xclient: xclient, auth: auth}
+			reply("250 2.1.0 ok")
+		case "RCPT":
+			addr := strings.Trim(strings.TrimPrefix(args, "TO:"), "<>")
+			if addr == s.opts.rejectRcpt {
+				reply("550 5.1.1 <%s>: no such user", addr)
+				continue
+			}
+			msg.to = append(msg.to, addr)
+			reply("250 2.1.5 ok")
+		case "DATA":
+			if len(msg.to) == 0 {
+				reply("554 5.5.1 no valid recipients")
+				continue
+			}
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			s.deliver(msg)
+			reply("250 2.0.0 Ok: queued as %s", s.queueID("Q"))
+		case "BDAT":
+			fields := strings.Fields(args)
+			size, _ := strconv.Atoi(fields[0])
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(text.R, chunk); err != nil {
+				return
+			}
+			bdat.Write(chunk)
+			if len(fields) < 2 {
+				reply("250 2.0.0 %d octets received", size)
+				continue
+			}
+			msg.data = bdat.String()
+			bdat.Reset()
+			s.deliver(msg)
+			reply("250 2.0.0 Ok: queued as %s", s.queueID("B"))
+		case "RSET":
+			msg = fakeMessage{}
+			reply("250 2.0.0 ok")
+		case "QUIT":
+			reply("221 2.0.0 bye")
+			return
+		default:
+			reply("502 5.5.2 command not recognized")
+		}
+	}
+}
+
+// testCertificate 生成测试用的自签名证书
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// sliceSource 按顺序返回给定的邮件
+type sliceSource struct {
+	messages []*utils.Message
+}
+
+func (s *sliceSource) Next() (*utils.Message, error) {
+	if len(s.messages) == 0 {
+		return nil, io.EOF
+	}
+	msg := s.messages[0]
+	s.messages = s.messages[1:]
+	return msg, nil
+}
+
+func (s *sliceSource) Close() error {
+	return nil
+}
+
+// runMessages 使用 cfg 发送 messages，返回按发送顺序排列的结果
+func runMessages(t *testing.T, cfg Config, messages ...*utils.Message) []*Result {
+	t.Helper()
+	engine, err := NewEngine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return runEngine(t, engine, messages...)
+}
+
+// runEngine 用已经创建的引擎发送 messages，测试可以在运行前替换引擎的时钟
+func runEngine(t *testing.T, engine *Engine, messages ...*utils.Message) []*Result {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var results []*Result
+	for res := range engine.Run(ctx, &sliceSource{messages: messages}) {
+		results = append(results, res)
+	}
+	if len(results) != len(messages) {
+		t.Fatalf("结果数量为 %d，期望 %d", len(results), len(messages))
+	}
+	return results
+}
+
+func replyCommands(replies []Reply) []string {
+	commands := make([]string, len(replies))
+	for i, r := range replies {
+		commands[i] = r.Command
+	}
+	return commands
+}
+
+const testContent = "Subject: test\nFrom: a@example.com\n\nhello\n.dot line\nworld\n"
+
+func TestEngineSend(t *testing.T) {
+	tests := []struct {
+		name string
+		opts fakeOptions
+		cfg  Config
+		env  *utils.Envelope
+		// check 检查结果和服务器收到的邮件
+		check func(t *testing.T, res *Result, got []fakeMessage)
+	}{
+		{
+			name: "data",
+			cfg:  Config{TLSMode: TLSNone},
+			check: func(t *testing.T, res *Result, got []fakeMessage) {
+				if !res.OK() || res.Reply.QueueID != "Q1" || res.Reply.Enhanced != "2.0.0" {
+					t.Fatalf("结果错误：%+v %v", res.Reply, res.Err)
+				}
+				want := []string{CommandConnect, "EHLO", "MAIL", "RCPT", "DATA", CommandDataEnd, "QUIT"}
+				if commands := replyCommands(res.Replies); !reflect.DeepEqual(commands, want) {
+					t.Fatalf("响应对应的命令为 %v，期望 %v", commands, want)
+				}
+				// DotReader 会去掉点转义并将CRLF还原为LF
+				if len(got) != 1 || got[0].data != testContent {
+					t.Fatalf("服务器收到的邮件错误：%+v", got)
+				}
+			},
+		},
+		{
+			name: "pipelining partial reject",
+			opts: fakeOptions{pipelining: true, rejectRcpt: "bad@example.com"},
+			cfg:  Config{TLSMode: TLSNone, Pipelining: true},
+			env:  &utils.Envelope{From: "from@example.com", To: []string{"a@example.com", "bad@example.com", "b@example.com"}},
+			check: func(t *testing.T, res *Result, got []fakeMessage) {
+				if !res.OK() || !res.Pipelined {
+					t.Fatalf("结果错误：pipelined=%v %v", res.Pipelined, res.Err)
+				}
+				accepted := 0
+				for _, rcpt := range res.Rcpts {
+					if rcpt.Accepted() {
+						accepted++
+					}
+				}
+				if len(res.Rcpts) != 3 || accepted != 2 {
+					t.Fatalf("收件人结果错误：%+v", res.Rcpts)
+				}
+				if len(got) != 1 || got[0].from != "from@example.com" || !reflect.DeepEqual(got[0].to, []string{"a@example.com", "b@example.com"}) {
+					t.Fatalf("服务器收到的信封错误：%+v", got)
+				}
+			},
+		},
+		{
+			name: "pipelining all rejected",
+			opts: fakeOptions{pipelining: true, rejectRcpt: "bad@example.com"},
+			cfg:  Config{TLSMode: TLSNone, Pipelining: true},
+			env:  &utils.Envelope{From: "from@example.com", To: []string{"bad@example.com"}},
+			check: func(t *testing.T, res *Result, got []fakeMessage) {
+				if res.OK() || res.Stage != StageRcpt || res.ErrorClass() != ClassRejected {
+					t.Fatalf("结果错误：stage=%s %v", res.Stage, res.Err)
+				}
+				if res.Reply.Command != "RCPT" || res.Reply.Code != 550 || res.Reply.Enhanced != "5.1.1" {
+					t.Fatalf("失败响应错误：%+v", res.Reply)
+				}
+				if len(got) != 0 {
+					t.Fatalf("服务器不应收到邮件：%+v", got)
+				}
+			},
+		},
+		{
+			name: "bdat chunks",
+			opts: fakeOptions{chunking: true, pipelining: true},
+			cfg:  Config{TLSMode: TLSNone, Chunking: true, Pipelining: true, ChunkSize: 10},
+			check: func(t *testing.T, res *Result, got []fakeMessage) {
+				if !res.OK() || !res.Chunked || res.Reply.QueueID != "B1" {
+					t.Fatalf("结果错误：chunked=%v %+v %v", res.Chunked, res.Reply, res.Err)
+				}
+				// BDAT 不做点转义，只把单独的LF转换为CRLF
+				if len(got) != 1 || got[0].data != strings.ReplaceAll(testContent, "\n", "\r\n") {
+					t.Fatalf("服务器收到的邮件错误：%+v", got)
+				}
+			},
+		},
+		{
+			name: "starttls",
+			opts: fakeOptions{startTLS: true},
+			cfg:  Config{TLSMode: TLSStartTLS},
+			check: func(t *testing.T, res *Result, got []fakeMessage) {
+				if !res.OK() || res.TLSVersion == "" || res.Timings.TLS <= 0 {
+					t.Fatalf("结果错误：tls=%q %v", res.TLSVersion, res.Err)
+				}
+				want := []string{CommandConnect, "EHLO", "STARTTLS", "EHLO", "MAIL", "RCPT", "DATA", CommandDataEnd, "QUIT"}
+				if commands := replyCommands(res.Replies); !reflect.DeepEqual(commands, want) {
+					t.Fatalf("响应对应的命令为 %v，期望 %v", commands, want)
+				}
+			},
+		},
+		{
+			name: "starttls required but unsupported",
+			cfg:  Config{TLSMode: TLSStartTLSRequired},
+			check: func(t *testing.T, res *Result, got []fakeMessage) {
+				if res.OK() || res.Stage != StageTLS {
+					t.Fatalf("结果错误：stage=%s %v", res.Stage, res.Err)
+				}
+			},
+		},
+		{
+			name: "xclient",
+			opts: fakeOptions{xclient: true},
+			cfg:  Config{TLSMode: TLSNone, XClient: true},
+			env:  &utils.Envelope{From: "from@example.com", To: []string{"a@example.com"}, ClientIP: "192.0.2.1"},
+			check: func(t *testing.T, res *Result, got []fakeMessage) {
+				if !res.OK() || res.ClientIP != "192.0.2.1" {
+					t.Fatalf("结果错误：clientIP=%q %v", res.ClientIP, res.Err)
+				}
+				if len(got) != 1 || got[0].xclient != "ADDR=192.0.2.1" {
+					t.Fatalf("服务器收到的XCLIENT错误：%+v", got)
+				}
+			},
+		},
+		{
+			// XCLIENT 在认证之前发送，IPv6 地址带 IPV6: 前缀
+			name: "xclient login",
+			opts: fakeOptions{xclient: true},
+			cfg:  Config{TLSMode: TLSNone, XClient: true, Login: true, Password: "secret"},
+			env:  &utils.Envelope{From: "from@example.com", To: []string{"a@example.com"}, ClientIP: "2001:db8::1"},
+			check: func(t *testing.T, res *Result, got []fakeMessage) {
+				if !res.OK() || res.Timings.Auth <= 0 {
+					t.Fatalf("结果错误：%v", res.Err)
+				}
+				want := []string{CommandConnect, "EHLO", "XCLIENT", "EHLO", "AUTH", "MAIL", "RCPT", "DATA", CommandDataEnd, "QUIT"}
+				if commands := replyCommands(res.Replies); !reflect.DeepEqual(commands, want) {
+					t.Fatalf("响应对应的命令为 %v，期望 %v", commands, want)
+				}
+				if len(got) != 1 || got[0].xclient != "ADDR=IPV6:2001:db8::1" || !got[0].auth {
+					t.Fatalf("服务器收到的邮件错误：%+v", got)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, tt.opts)
+			cfg := tt.cfg
+			cfg.Server, cfg.Port = "127.0.0.1", server.port()
+			cfg.From, cfg.To = "from@example.com", "to@example.com"
+			res := runMessages(t, cfg, &utils.Message{Path: "test.eml", Content: []byte(testContent), Envelope: tt.env})[0]
+			tt.check(t, res, server.received())
+		})
+	}
+}
+
+func TestEngineReuseConnection(t *testing.T) {
+	server := newFakeServer(t, fakeOptions{})
+	cfg := Config{Server: "127.0.0.1", Port: server.port(), TLSMode: TLSNone, From: "from@example.com", To: "to@example.com", MessagesPerConn: 3}
+	var messages []*utils.Message
+	for i := 0; i < 4; i++ {
+		messages = append(messages, &utils.Message{Path: fmt.Sprintf("%d.eml", i), Content: []byte(testContent)})
+	}
+	results := runMessages(t, cfg, messages...)
+	wantReused := []bool{false, true, true, false}
+	for i, res := range results {
+		if !res.OK() || res.Reused != wantReused[i] || res.NewConn == wantReused[i] {
+			t.Fatalf("第%d封结果错误：reused=%v newConn=%v %v", i, res.Reused, res.NewConn, res.Err)
+		}
+	}
+	// 复用连接时从RSET开始记录响应
+	if commands := replyCommands(results[1].Replies); commands[0] != "RSET" {
+		t.Fatalf("复用连接的响应为 %v", commands)
+	}
+	if got := len(server.received()); got != 4 {
+		t.Fatalf("服务器收到 %d 封邮件", got)
+	}
+}
+
+func TestEngineXClientReauth(t *testing.T) {
+	server := newFakeServer(t, fakeOptions{xclient: true})
+	cfg := Config{Server: "127.0.0.1", Port: server.port(), TLSMode: TLSNone, From: "from@example.com", To: "to@example.com",
+		XClient: true, Login: true, Password: "secret", MessagesPerConn: 3}
+	var messages []*utils.Message
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", ""} {
+		env := &utils.Envelope{From: "from@example.com", To: []string{"a@example.com"}, ClientIP: ip}
+		messages = append(messages, &utils.Message{Path: ip + ".eml", Content: []byte(testContent), Envelope: env})
+	}
+	for i, res := range runMessages(t, cfg, messages...) {
+		if !res.OK() {
+			t.Fatalf("第%d封发送失败：%v", i, res.Err)
+		}
+	}
+	// 复用连接时每次XCLIENT之后重新认证，没有客户端IP时沿用之前的会话
+	got := server.received()
+	wantXClient := []string{"ADDR=192.0.2.1", "ADDR=192.0.2.2", "ADDR=192.0.2.2"}
+	for i, msg := range got {
+		if !msg.auth || msg.xclient != wantXClient[i] {
+			t.Fatalf("第%d封邮件错误：%+v", i, msg)
+		}
+	}
+}
+
+func TestEngineRecipientRotation(t *testing.T) {
+	// 信封中有收件人的邮件不占用收件人列表的轮换位置
+	server := newFakeServer(t, fakeOptions{})
+	cfg := Config{Server: "127.0.0.1", Port: server.port(), TLSMode: TLSNone, From: "from@example.com",
+		Recipients: []string{"r1@example.com", "r2@example.com"}}
+	results := runMessages(t, cfg,
+		&utils.Message{Path: "1", Content: []byte(testContent), Envelope: &utils.Envelope{To: []string{"env@example.com"}}},
+		&utils.Message{Path: "2", Content: []byte(testContent)},
+		&utils.Message{Path: "3", Content: []byte(testContent)})
+	var got []string
+	for _, res := range results {
+		got = append(got, strings.Join(res.To, ","))
+	}
+	if want := "env@example.com r1@example.com r2@example.com"; strings.Join(got, " ") != want {
+		t.Errorf("收件人为 %q，期望 %s", got, want)
+	}
+}
+
+func TestEngineOpenModel(t *testing.T) {
+	if _, err := NewEngine(Config{OpenModel: true}); err == nil {
+		t.Error("开放模型没有设置速率时应当返回错误")
+	}
+	if _, err := NewEngine(Config{OpenModel: true, Rate: 1, Arrival: "uniform"}); err == nil {
+		t.Error("不支持的到达间隔分布应当返回错误")
+	}
+
+	// 邮件数速率足够高，派发速率由 ByteRate 限制：突发1000字节后每封500字节的邮件需要等待0.5秒
+	server := newFakeServer(t, fakeOptions{})
+	cfg := Config{Server: "127.0.0.1", Port: server.port(), TLSMode: TLSNone, From: "from@example.com", To: "to@example.com",
+		OpenModel: true, Arrival: ArrivalFixed, Rate: 1000, ByteRate: 1000}
+	engine, err := NewEngine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 字节限速使用虚拟时钟，等待的时长即为按字节速率推迟派发的时长
+	clock := newFakeClock()
+	clock.use(engine.limiter.bytes)
+	start := clock.now()
+	content := []byte("Subject: open\r\n\r\n" + strings.Repeat("x", 500-len("Subject: open\r\n\r\n")))
+	results := runEngine(t, engine, &utils.Message{Path: "1", Content: content}, &utils.Message{Path: "2", Content: content},
+		&utils.Message{Path: "3", Content: content}, &utils.Message{Path: "4", Content: content})
+	if waited := clock.now().Sub(start); !durationNear(waited, time.Second) {
+		t.Errorf("开放模型没有按字节速率派发，等待 %s，期望 1s", waited)
+	}
+	for _, res := range results {
+		if !res.OK() {
+			t.Errorf("%s 发送失败：%v", res.Path, res.Err)
+		}
+	}
+}
+
+func TestXClientAddr(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "IPV6:2001:db8::1"},
+		{"::ffff:192.0.2.1", "::ffff:192.0.2.1"},
+		{"[UNAVAILABLE]", "[UNAVAILABLE]"},
+	}
+	for _, tt := range tests {
+		if got := xclientAddr(tt.in); got != tt.want {
+			t.Errorf("xclientAddr(%q) = %q，期望 %q", tt.in, got, tt.want)
+		}
+	}
+	if got := xtext("a+b=c d\xff"); got != "a+2Bb+3Dc+20d+FF" {
+		t.Errorf("xtext = %q", got)
+	}
+}
+
+func TestToCRLF(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"a\r\nb", "a\r\nb"},
+		{"a\nb\n", "a\r\nb\r\n"},
+		{"\na\r\n\n", "\r\na\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		if got := string(toCRLF([]byte(tt.in))); got != tt.want {
+			t.Errorf("toCRLF(%q) = %q，期望 %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewReply(t *testing.T) {
+	tests := []struct {
+		text     string
+		enhanced string
+		queueID  string
+	}{
+		{"2.0.0 Ok: queued as 4Q2abcXYZ", "2.0.0", "4Q2abcXYZ"},
+		{"OK id=1qAbCd-0001Xy-2Z", "", "1qAbCd-0001Xy-2Z"},
+		{"2.0.0 3AB12CD Message accepted for delivery", "2.0.0", "3AB12CD"},
+		{"5.1.1 <bad@example.com>: no such user", "5.1.1", ""},
+		{"mx.example.com\nPIPELINING", "", ""},
+	}
+	for _, tt := range tests {
+		r := newReply(250, tt.text)
+		if r.Enhanced != tt.enhanced || r.QueueID != tt.queueID {
+			t.Errorf("newReply(%q) = %+v，期望增强状态码 %q 队列ID %q", tt.text, r, tt.enhanced, tt.queueID)
+		}
+	}
+}
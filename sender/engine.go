@@ -0,0 +1,239 @@
+package sender
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"sendmail/utils"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config 发件引擎配置
+type Config struct {
+	Server string
+	Port   int
+	// TLSMode 为 auto,none,starttls,starttls-required,implicit 之一，为空时等同于 auto
+	TLSMode string
+	// TLSConfig 为 nil 时跳过证书校验，可以通过 NewTLSConfig 创建
+	TLSConfig *tls.Config
+	// Thread 并发发送的协程数
+	Thread int
+	// Sleep 每封邮件派发前的间隔时间
+	Sleep time.Duration
+	// Faithful 为 true 时按邮件的 Timestamp 还原原始的到达间隔，忽略 Sleep
+	Faithful bool
+	// Speed 还原到达间隔时的倍速，小于等于0时等同于1
+	Speed float64
+	// MaxGap 大于0时，还原的两封邮件之间的间隔不超过该时长
+	MaxGap time.Duration
+	// Rate 大于0时按令牌桶限制每秒派发的邮件数，Burst 为允许突发的邮件数，小于1时等同于1
+	Rate  float64
+	Burst int
+	// ByteRate 大于0时限制每秒派发的邮件字节数，ByteBurst 小于等于0时等同于 ByteRate
+	ByteRate  float64
+	ByteBurst int
+	// Profile 不为空时按负载曲线调整每秒派发的邮件数，代替 Rate，曲线结束后停止发送
+	Profile Profile
+	// OpenModel 为 true 时按开放模型发送：按 Rate 或 Profile 的速率（设置 Faithful 时按原始到达时间）
+	// 为每封邮件新建协程和连接，不受 Thread 限制，Arrival 为 poisson 或 fixed，为空时等同于 poisson
+	OpenModel bool
+	Arrival   string
+	// MaxInFlight 开放模型中进行中的邮件数上限，达到上限时放弃发送，为0时不限制
+	MaxInFlight int
+	// TimeThreshold 大于0时，到达该时长后停止发送
+	TimeThreshold time.Duration
+	From          string
+	To            string
+	// Recipients 不为空时代替 To，按 RcptMode 为每封邮件分配 RcptPerMessage 个收件人
+	Recipients     []string
+	RcptPerMessage int
+	// RcptMode 为 roundrobin 或 random，为空时等同于 roundrobin
+	RcptMode string
+	// HeaderEnvelope 为 true 时，来源没有提供信封的邮件根据邮件头生成发件人和收件人
+	HeaderEnvelope bool
+	// XClient 为 true 且服务器支持XCLIENT时，使用信封中的原始客户端IP发送XCLIENT
+	XClient bool
+	// Accounts 不为空时轮流使用其中的账户作为发件人
+	Accounts []utils.Account
+	// Login 为 true 时在发送前进行SMTP认证
+	Login    bool
+	Password string
+	// Pipelining 为 true 且服务器支持PIPELINING时，批量发送MAIL、RCPT和DATA命令
+	Pipelining bool
+	// Chunking 为 true 且服务器支持CHUNKING时，使用BDAT发送邮件内容
+	Chunking bool
+	// ChunkSize BDAT每个分块的字节数，小于等于0时整封邮件作为一个分块
+	ChunkSize int
+	// MessagesPerConn 每条连接最多发送的邮件数，小于等于1时每封邮件新建一条连接
+	MessagesPerConn int
+	// IdleTimeout 复用连接时，连接空闲超过该时长后关闭，为0时不关闭
+	IdleTimeout time.Duration
+	// Metrics 不为 nil 时在发送过程中更新运行指标
+	Metrics *Metrics
+}
+
+// Engine 发件引擎，从 Source 读取邮件并发送到SMTP服务器
+type Engine struct {
+	cfg          Config
+	accountIndex uint64
+	recipients   *recipientPicker
+	limiter      *limiter
+	// stage 按负载曲线发送时当前所处的阶段名称
+	stage atomic.Value
+}
+
+// NewEngine 创建发件引擎，开放模型的配置无效时返回错误
+func NewEngine(cfg Config) (*Engine, error) {
+	if cfg.OpenModel {
+		if cfg.Arrival != "" && cfg.Arrival != ArrivalPoisson && cfg.Arrival != ArrivalFixed {
+			return nil, fmt.Errorf("不支持的到达间隔分布：%s", cfg.Arrival)
+		}
+		// 没有速率时开放模型无法计算到达时间
+		if cfg.Rate <= 0 && len(cfg.Profile) == 0 && !cfg.Faithful {
+			return nil, errors.New("开放模型需要设置rate、profile或faithful")
+		}
+	}
+	if cfg.Thread < 1 {
+		cfg.Thread = 1
+	}
+	e := &Engine{cfg: cfg}
+	e.limiter = e.newLimiter()
+	if len(cfg.Profile) > 0 {
+		e.stage.Store(cfg.Profile[0].Name)
+	}
+	if len(cfg.Recipients) > 0 {
+		e.recipients = newRecipientPicker(cfg.Recipients, cfg.RcptPerMessage, cfg.RcptMode)
+	}
+	return e, nil
+}
+
+// Run 开始发送邮件，每封邮件的结果写入返回的通道，
+// 来源读取完毕、ctx 取消或到达时间阈值后通道关闭
+func (e *Engine) Run(ctx context.Context, src utils.Source) <-chan *Result {
+	results := make(chan *Result, e.cfg.Thread)
+	go func() {
+		defer close(results)
+		if e.cfg.TimeThreshold > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, e.cfg.TimeThreshold)
+			defer cancel()
+		}
+		if len(e.cfg.Profile) > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, e.cfg.Profile.Duration())
+			defer cancel()
+			go e.applyProfile(ctx)
+		}
+		if e.cfg.OpenModel {
+			e.dispatchOpen(ctx, src, results)
+			return
+		}
+		jobs := make(chan *utils.Message)
+		var wg sync.WaitGroup
+		for i := 0; i < e.cfg.Thread; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := &worker{e: e}
+				w.run(jobs, results)
+			}()
+		}
+		e.dispatch(ctx, src, jobs, results)
+		close(jobs)
+		wg.Wait()
+	}()
+	return results
+}
+
+// dispatch 从来源读取邮件并派发给工作协程
+func (e *Engine) dispatch(ctx context.Context, src utils.Source, jobs chan<- *utils.Message, results chan<- *Result) {
+	pace := e.newPacer()
+	defer pace.close()
+	for {
+		msg, ok := e.next(ctx, src, results)
+		if !ok {
+			return
+		}
+		if !pace.wait(ctx, msg) || !e.limiter.wait(ctx, msg) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case jobs <- msg:
+		}
+	}
+}
+
+// next 从来源读取下一封邮件，读取失败的邮件作为结果写入 results 后跳过，
+// 来源读取完毕、不可用或 ctx 取消时返回 false
+func (e *Engine) next(ctx context.Context, src utils.Source, results chan<- *Result) (*utils.Message, bool) {
+	for ctx.Err() == nil {
+		msg, err := src.Next()
+		if err == io.EOF {
+			return nil, false
+		}
+		if err == nil {
+			return msg, true
+		}
+		res := &Result{Start: time.Now(), LoadStage: e.loadStage(), Stage: StageSource, Err: err}
+		if msg != nil {
+			res.Path = msg.Path
+			res.FetchTime = msg.FetchDuration
+		}
+		e.cfg.Metrics.observe(res)
+		results <- res
+		if msg == nil {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// applyProfile 按负载曲线定时调整限速器的速率，ctx 结束后返回
+func (e *Engine) applyProfile(ctx context.Context) {
+	start := time.Now()
+	ticker := time.NewTicker(maxLimiterWait)
+	defer ticker.Stop()
+	for {
+		stage, rate, ok := e.cfg.Profile.At(time.Since(start))
+		if !ok {
+			return
+		}
+		e.stage.Store(stage.Name)
+		e.limiter.messages.setRate(rate)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// loadStage 返回负载曲线当前所处的阶段，没有设置负载曲线时为空
+func (e *Engine) loadStage() string {
+	stage, _ := e.stage.Load().(string)
+	return stage
+}
+
+// account 轮流选取发件账户
+func (e *Engine) account() (string, string) {
+	if len(e.cfg.Accounts) == 0 {
+		return e.cfg.From, e.cfg.Password
+	}
+	i := atomic.AddUint64(&e.accountIndex, 1) - 1
+	account := e.cfg.Accounts[i%uint64(len(e.cfg.Accounts))]
+	return account.Username, account.Password
+}
+
+// rcptTo 为一封邮件分配收件人
+func (e *Engine) rcptTo() []string {
+	if e.recipients == nil {
+		return []string{e.cfg.To}
+	}
+	return e.recipients.pick()
+}
@@ -0,0 +1,144 @@
+package sender
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 直方图按微秒记录耗时，小于 histogramLinear 的值精确记录，
+// 更大的值按2的幂分段，每段再等分为 histogramSub 个桶，相对误差不超过 1/histogramSub
+const (
+	histogramLinear = 128
+	histogramSub    = 64
+)
+
+// histogramIndex 返回耗时所在的桶
+func histogramIndex(us uint64) int {
+	if us < histogramLinear {
+		return int(us)
+	}
+	shift := bits.Len64(us) - 7
+	return histogramLinear + (shift-1)*histogramSub + int(us>>uint(shift)) - histogramSub
+}
+
+// histogramValue 返回桶内的最大值，单位为微秒
+func histogramValue(index int) uint64 {
+	if index < histogramLinear {
+		return uint64(index)
+	}
+	shift := (index-histogramLinear)/histogramSub + 1
+	sub := uint64((index-histogramLinear)%histogramSub + histogramSub)
+	return (sub+1)<<uint(shift) - 1
+}
+
+// Histogram 并发安全的耗时直方图，类似HDR Histogram，按桶稀疏存储
+type Histogram struct {
+	mu     sync.Mutex
+	counts map[int]uint64
+	count  uint64
+	min    time.Duration
+	max    time.Duration
+	sum    float64
+	sumSq  float64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: map[int]uint64{}}
+}
+
+// Record 记录一次耗时
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[histogramIndex(uint64(d/time.Microsecond))]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += float64(d)
+	h.sumSq += float64(d) * float64(d)
+}
+
+// Count 记录的次数
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// HistogramSnapshot 直方图的统计结果
+type HistogramSnapshot struct {
+	Count  uint64
+	Min    time.Duration
+	Max    time.Duration
+	Mean   time.Duration
+	StdDev time.Duration
+	P50    time.Duration
+	P90    time.Duration
+	P95    time.Duration
+	P99    time.Duration
+	P999   time.Duration
+}
+
+// Snapshot 返回当前的统计结果，没有记录时所有值为0
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return HistogramSnapshot{}
+	}
+	mean := h.sum / float64(h.count)
+	variance := h.sumSq/float64(h.count) - mean*mean
+	if variance < 0 {
+		variance = 0
+	}
+	s := HistogramSnapshot{
+		Count:  h.count,
+		Min:    h.min,
+		Max:    h.max,
+		Mean:   time.Duration(mean),
+		StdDev: time.Duration(math.Sqrt(variance)),
+	}
+	indexes := make([]int, 0, len(h.counts))
+	for index := range h.counts {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	quantiles := []struct {
+		q     float64
+		value *time.Duration
+	}{{0.5, &s.P50}, {0.9, &s.P90}, {0.95, &s.P95}, {0.99, &s.P99}, {0.999, &s.P999}}
+	var seen uint64
+	i := 0
+	for _, index := range indexes {
+		seen += h.counts[index]
+		for ; i < len(quantiles) && float64(seen) >= quantiles[i].q*float64(h.count); i++ {
+			*quantiles[i].value = h.clamp(histogramValue(index))
+		}
+	}
+	for ; i < len(quantiles); i++ {
+		*quantiles[i].value = h.max
+	}
+	return s
+}
+
+// clamp 将桶的上界限制在记录的最小值和最大值之间，调用前需要持有锁
+func (h *Histogram) clamp(us uint64) time.Duration {
+	d := time.Duration(us) * time.Microsecond
+	if d > h.max {
+		return h.max
+	}
+	if d < h.min {
+		return h.min
+	}
+	return d
+}
@@ -0,0 +1,87 @@
+package sender
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestHistogramIndex(t *testing.T) {
+	// 桶的上界不小于落入该桶的值，相对误差不超过 1/histogramSub
+	for _, us := range []uint64{0, 1, 127, 128, 129, 255, 256, 1000, 12345, 1 << 20, 1<<40 + 7} {
+		upper := histogramValue(histogramIndex(us))
+		if upper < us || float64(upper-us) > float64(us)/histogramSub+1 {
+			t.Errorf("%dus 所在桶的上界为 %dus", us, upper)
+		}
+	}
+}
+
+func TestHistogramSnapshot(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []time.Duration
+		want   HistogramSnapshot
+	}{
+		{name: "empty", want: HistogramSnapshot{}},
+		{
+			name:   "single",
+			values: []time.Duration{5 * time.Millisecond},
+			want: HistogramSnapshot{Count: 1, Min: 5 * time.Millisecond, Max: 5 * time.Millisecond, Mean: 5 * time.Millisecond,
+				P50: 5 * time.Millisecond, P90: 5 * time.Millisecond, P95: 5 * time.Millisecond, P99: 5 * time.Millisecond, P999: 5 * time.Millisecond},
+		},
+		{
+			// 小于 histogramLinear 微秒的值精确记录
+			name:   "linear",
+			values: []time.Duration{10 * time.Microsecond, 20 * time.Microsecond, 30 * time.Microsecond, 40 * time.Microsecond},
+			want: HistogramSnapshot{Count: 4, Min: 10 * time.Microsecond, Max: 40 * time.Microsecond, Mean: 25 * time.Microsecond,
+				StdDev: 11180 * time.Nanosecond, P50: 20 * time.Microsecond, P90: 40 * time.Microsecond, P95: 40 * time.Microsecond,
+				P99: 40 * time.Microsecond, P999: 40 * time.Microsecond},
+		},
+		{
+			name:   "negative as zero",
+			values: []time.Duration{-time.Second},
+			want:   HistogramSnapshot{Count: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHistogram()
+			for _, v := range tt.values {
+				h.Record(v)
+			}
+			got := h.Snapshot()
+			got.StdDev = got.StdDev.Round(10 * time.Nanosecond)
+			if got != tt.want {
+				t.Fatalf("Snapshot = %+v，期望 %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogramPercentileAccuracy(t *testing.T) {
+	// 耗时分布跨越多个数量级，百分位与精确值的相对误差不超过 1/histogramSub
+	rnd := rand.New(rand.NewSource(1))
+	h := NewHistogram()
+	values := make([]time.Duration, 100000)
+	for i := range values {
+		us := int64(math.Exp(rnd.NormFloat64()*2 + 9))
+		values[i] = time.Duration(us) * time.Microsecond
+		h.Record(values[i])
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	got := h.Snapshot()
+	for _, tt := range []struct {
+		q   float64
+		got time.Duration
+	}{{0.5, got.P50}, {0.9, got.P90}, {0.95, got.P95}, {0.99, got.P99}, {0.999, got.P999}} {
+		exact := values[int(math.Ceil(tt.q*float64(len(values))))-1]
+		if tt.got < exact || float64(tt.got-exact) > float64(exact)/histogramSub+float64(time.Microsecond) {
+			t.Errorf("P%g = %s，精确值为 %s", tt.q*100, tt.got, exact)
+		}
+	}
+	if got.Min != values[0] || got.Max != values[len(values)-1] {
+		t.Errorf("Min = %s，Max = %s，期望 %s 和 %s", got.Min, got.Max, values[0], values[len(values)-1])
+	}
+}
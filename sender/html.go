@@ -0,0 +1,354 @@
+package sender
+
+import (
+	"html/template"
+	"io"
+	"math"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// htmlMaxPoints 自动选择时间段长度时图表中最多的点数
+const htmlMaxPoints = 200
+
+// htmlLimitPoints 手动设置时间段时图表中最多的点数，超过时改为自动选择时间段
+const htmlLimitPoints = 2000
+
+// htmlMaxGroups 按账户和来源统计的表格中最多显示的行数，按邮件数从多到少排列
+const htmlMaxGroups = 50
+
+// htmlIntervals 自动选择时间段长度时的候选值
+var htmlIntervals = []time.Duration{
+	time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 15 * time.Second, 30 * time.Second,
+	time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute, time.Hour,
+}
+
+// classColors 各结果分类在图表中的颜色
+var classColors = map[string]string{
+	ClassOK:         "#2e9d57",
+	ClassDeferred:   "#e69a17",
+	ClassRejected:   "#d64541",
+	ClassDNS:        "#8e44ad",
+	ClassConnect:    "#6c5ce7",
+	ClassTLS:        "#3d7bd9",
+	ClassTimeout:    "#b9770e",
+	ClassConnection: "#7f8c8d",
+	ClassSource:     "#95a5a6",
+	ClassDropped:    "#34495e",
+}
+
+// groupRow 按账户或来源统计的一行
+type groupRow struct {
+	Name        string
+	Total       int
+	Success     int
+	Failed      int
+	SuccessRate string
+	Mean        string
+	P50         string
+	P95         string
+	P99         string
+}
+
+type groupStats struct {
+	name    string
+	total   int
+	success int
+	latency *Histogram
+}
+
+func (g *groupStats) add(rec Record) {
+	g.total++
+	if rec.Class == ClassOK {
+		g.success++
+		g.latency.Record(time.Duration(rec.DurationMs * float64(time.Millisecond)))
+	}
+}
+
+// row 返回统计结果，没有成功邮件时耗时显示为 -
+func (g *groupStats) row() groupRow {
+	row := groupRow{
+		Name:        g.name,
+		Total:       g.total,
+		Success:     g.success,
+		Failed:      g.total - g.success,
+		SuccessRate: formatValue(float64(g.success)/float64(g.total)*100) + "%",
+		Mean:        "-",
+		P50:         "-",
+		P95:         "-",
+		P99:         "-",
+	}
+	if g.success > 0 {
+		l := g.latency.Snapshot()
+		row.Mean, row.P50 = formatMs(milliseconds(l.Mean)), formatMs(milliseconds(l.P50))
+		row.P95, row.P99 = formatMs(milliseconds(l.P95)), formatMs(milliseconds(l.P99))
+	}
+	return row
+}
+
+// groupBy 按 key 分组统计，返回按邮件数从多到少排列的前 htmlMaxGroups 行和分组总数
+func groupBy(records []Record, key func(Record) string) ([]groupRow, int) {
+	groups := map[string]*groupStats{}
+	for _, rec := range records {
+		name := key(rec)
+		g, ok := groups[name]
+		if !ok {
+			g = &groupStats{name: name, latency: NewHistogram()}
+			groups[name] = g
+		}
+		g.add(rec)
+	}
+	rows := make([]groupRow, 0, len(groups))
+	for _, g := range groups {
+		rows = append(rows, g.row())
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Total != rows[j].Total {
+			return rows[i].Total > rows[j].Total
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	if len(rows) > htmlMaxGroups {
+		return rows[:htmlMaxGroups], len(rows)
+	}
+	return rows, len(rows)
+}
+
+// recordSource 邮件的来源，有原始客户端IP时为客户端IP，否则为邮件路径所在的目录
+func recordSource(rec Record) string {
+	if rec.ClientIP != "" {
+		return rec.ClientIP
+	}
+	return path.Dir(filepath.ToSlash(rec.Path))
+}
+
+// replyCode 响应码分布中的分类，没有收到服务器响应时使用结果分类
+func replyCode(rec Record) string {
+	if rec.Code != 0 {
+		return strconv.Itoa(rec.Code)
+	}
+	return rec.Class
+}
+
+// htmlInterval 选择时间段长度，使图表的点数不超过 htmlMaxPoints
+func htmlInterval(span time.Duration) time.Duration {
+	for _, interval := range htmlIntervals {
+		if span/interval < htmlMaxPoints {
+			return interval
+		}
+	}
+	return span/htmlMaxPoints + time.Second
+}
+
+// chartInterval 返回图表实际使用的时间段长度，interval 小于等于0或点数超过 htmlLimitPoints 时自动选择
+func chartInterval(span, interval time.Duration) time.Duration {
+	if interval <= 0 || span/interval >= htmlLimitPoints {
+		return htmlInterval(span)
+	}
+	return interval
+}
+
+type htmlPage struct {
+	Title       string
+	Generated   string
+	Start       string
+	End         string
+	Duration    time.Duration
+	Interval    time.Duration
+	Total       int
+	Success     int
+	Failed      int
+	SuccessRate string
+	Throughput  string
+	Latency     map[string]string
+
+	ThroughputChart template.HTML
+	LatencyChart    template.HTML
+	CodeChart       template.HTML
+
+	Classes     []groupRow
+	Accounts    []groupRow
+	AccountsAll int
+	Sources     []groupRow
+	SourcesAll  int
+}
+
+// WriteHTMLReport 根据报告中的记录生成独立的HTML页面，图表为内联的SVG，不依赖外部资源。
+// 吞吐量和耗时按邮件发送完成的时间分段统计，interval 为每段的长度，小于等于0或点数过多时自动选择
+func WriteHTMLReport(w io.Writer, title string, records []Record, interval time.Duration) error {
+	page := htmlPage{Title: title, Generated: time.Now().Format("2006-01-02 15:04:05"), Total: len(records)}
+	if len(records) == 0 {
+		return htmlTemplate.Execute(w, page)
+	}
+	start, end := records[0].Start, records[0].End
+	latency := NewHistogram()
+	for _, rec := range records {
+		if rec.Start.Before(start) {
+			start = rec.Start
+		}
+		if rec.End.After(end) {
+			end = rec.End
+		}
+		if rec.Class == ClassOK {
+			page.Success++
+			latency.Record(time.Duration(rec.DurationMs * float64(time.Millisecond)))
+		}
+	}
+	page.Failed = page.Total - page.Success
+	page.Start = start.Format("2006-01-02 15:04:05")
+	page.End = end.Format("2006-01-02 15:04:05")
+	span := end.Sub(start)
+	page.Duration = span.Round(time.Millisecond)
+	page.SuccessRate = formatValue(float64(page.Success)/float64(page.Total)*100) + "%"
+	if span > 0 {
+		page.Throughput = formatValue(float64(page.Success) / span.Seconds())
+	}
+	l := latency.Snapshot()
+	page.Latency = map[string]string{
+		"min": formatMs(milliseconds(l.Min)), "mean": formatMs(milliseconds(l.Mean)),
+		"p50": formatMs(milliseconds(l.P50)), "p90": formatMs(milliseconds(l.P90)), "p95": formatMs(milliseconds(l.P95)),
+		"p99": formatMs(milliseconds(l.P99)), "p99.9": formatMs(milliseconds(l.P999)), "max": formatMs(milliseconds(l.Max)),
+	}
+
+	interval = chartInterval(span, interval)
+	page.Interval = interval
+	page.ThroughputChart, page.LatencyChart = timeCharts(records, start, span, interval)
+	page.CodeChart = codeChart(records)
+	page.Classes, _ = groupBy(records, func(rec Record) string { return rec.Class })
+	page.Accounts, page.AccountsAll = groupBy(records, func(rec Record) string { return rec.Account })
+	page.Sources, page.SourcesAll = groupBy(records, recordSource)
+	return htmlTemplate.Execute(w, page)
+}
+
+// timeCharts 按发送完成的时间分段，生成每秒成功和失败邮件数的折线图以及成功邮件耗时分位数的折线图
+func timeCharts(records []Record, start time.Time, span, interval time.Duration) (template.HTML, template.HTML) {
+	n := int(span/interval) + 1
+	success := make([]float64, n)
+	failed := make([]float64, n)
+	latency := make([]*Histogram, n)
+	labels := make([]string, n)
+	for i := range latency {
+		latency[i] = NewHistogram()
+		labels[i] = (time.Duration(i) * interval).String()
+	}
+	for _, rec := range records {
+		i := int(rec.End.Sub(start) / interval)
+		if rec.Class == ClassOK {
+			success[i]++
+			latency[i].Record(time.Duration(rec.DurationMs * float64(time.Millisecond)))
+		} else {
+			failed[i]++
+		}
+	}
+	p50 := make([]float64, n)
+	p90 := make([]float64, n)
+	p99 := make([]float64, n)
+	for i := range latency {
+		success[i] /= interval.Seconds()
+		failed[i] /= interval.Seconds()
+		if latency[i].Count() == 0 {
+			p50[i], p90[i], p99[i] = math.NaN(), math.NaN(), math.NaN()
+			continue
+		}
+		l := latency[i].Snapshot()
+		p50[i], p90[i], p99[i] = milliseconds(l.P50), milliseconds(l.P90), milliseconds(l.P99)
+	}
+	throughput := lineChart(labels, "封/秒", []chartSeries{
+		{Name: "成功", Color: classColors[ClassOK], Values: success},
+		{Name: "失败", Color: classColors[ClassRejected], Values: failed},
+	})
+	percentiles := lineChart(labels, "毫秒", []chartSeries{
+		{Name: "p50", Color: "#3d7bd9", Values: p50},
+		{Name: "p90", Color: "#e69a17", Values: p90},
+		{Name: "p99", Color: "#d64541", Values: p99},
+	})
+	return throughput, percentiles
+}
+
+// codeChart 生成最终响应码分布的柱状图，按邮件数从多到少排列
+func codeChart(records []Record) template.HTML {
+	counts := map[string]int{}
+	classes := map[string]string{}
+	for _, rec := range records {
+		code := replyCode(rec)
+		counts[code]++
+		classes[code] = rec.Class
+	}
+	labels := make([]string, 0, len(counts))
+	for code := range counts {
+		labels = append(labels, code)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if counts[labels[i]] != counts[labels[j]] {
+			return counts[labels[i]] > counts[labels[j]]
+		}
+		return labels[i] < labels[j]
+	})
+	values := make([]float64, len(labels))
+	colors := make([]string, len(labels))
+	for i, code := range labels {
+		values[i] = float64(counts[code])
+		colors[i] = classColors[classes[code]]
+		if colors[i] == "" {
+			colors[i] = classColors[ClassConnection]
+		}
+	}
+	return barChart(labels, values, colors)
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", "PingFang SC", "Microsoft YaHei", sans-serif; margin: 24px auto; max-width: 1000px; color: #222; }
+h1 { font-size: 22px; } h2 { font-size: 17px; margin-top: 32px; border-bottom: 1px solid #ddd; padding-bottom: 4px; }
+table { border-collapse: collapse; font-size: 13px; margin: 8px 0; }
+th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: right; }
+th { background: #f5f5f5; } td:first-child, th:first-child { text-align: left; }
+.meta { color: #666; font-size: 13px; }
+.chart { width: 100%; height: auto; }
+.chart .grid { stroke: #e5e5e5; } .chart text { font-size: 12px; fill: #555; }
+.chart .unit { fill: #888; } .chart .legend { fill: #333; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">生成时间：{{.Generated}}</p>
+{{if not .Total}}<p>报告中没有邮件记录</p>{{else}}
+<h2>汇总</h2>
+<table>
+<tr><th>开始时间</th><td>{{.Start}}</td><th>结束时间</th><td>{{.End}}</td><th>持续时间</th><td>{{.Duration}}</td></tr>
+<tr><th>邮件总数</th><td>{{.Total}}</td><th>成功</th><td>{{.Success}}</td><th>失败</th><td>{{.Failed}}</td></tr>
+<tr><th>成功率</th><td>{{.SuccessRate}}</td><th>吞吐量(封/秒)</th><td>{{.Throughput}}</td><th>统计时间段</th><td>{{.Interval}}</td></tr>
+</table>
+<table>
+<tr><th>耗时(ms)</th><th>min</th><th>mean</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>p99.9</th><th>max</th></tr>
+<tr><td>成功邮件</td><td>{{index .Latency "min"}}</td><td>{{index .Latency "mean"}}</td><td>{{index .Latency "p50"}}</td><td>{{index .Latency "p90"}}</td><td>{{index .Latency "p95"}}</td><td>{{index .Latency "p99"}}</td><td>{{index .Latency "p99.9"}}</td><td>{{index .Latency "max"}}</td></tr>
+</table>
+<h2>吞吐量</h2>
+{{.ThroughputChart}}
+<h2>耗时分位数</h2>
+{{.LatencyChart}}
+<h2>响应码分布</h2>
+{{.CodeChart}}
+<h2>结果分类</h2>
+{{template "groups" .Classes}}
+<h2>按账户统计</h2>
+{{if lt (len .Accounts) .AccountsAll}}<p class="meta">共{{.AccountsAll}}个账户，只显示邮件数最多的{{len .Accounts}}个</p>{{end}}
+{{template "groups" .Accounts}}
+<h2>按来源统计</h2>
+<p class="meta">来源为邮件的原始客户端IP，没有时为邮件路径所在的目录{{if lt (len .Sources) .SourcesAll}}，共{{.SourcesAll}}个来源，只显示邮件数最多的{{len .Sources}}个{{end}}</p>
+{{template "groups" .Sources}}
+{{end}}
+</body>
+</html>
+{{define "groups"}}<table>
+<tr><th>名称</th><th>总数</th><th>成功</th><th>失败</th><th>成功率</th><th>平均耗时(ms)</th><th>p50(ms)</th><th>p95(ms)</th><th>p99(ms)</th></tr>
+{{range .}}<tr><td>{{if .Name}}{{.Name}}{{else}}-{{end}}</td><td>{{.Total}}</td><td>{{.Success}}</td><td>{{.Failed}}</td><td>{{.SuccessRate}}</td><td>{{.Mean}}</td><td>{{.P50}}</td><td>{{.P95}}</td><td>{{.P99}}</td></tr>
+{{end}}</table>{{end}}
+`))
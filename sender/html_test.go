@@ -0,0 +1,52 @@
+package sender
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestChartInterval(t *testing.T) {
+	tests := []struct {
+		span, interval, want time.Duration
+	}{
+		{span: time.Minute, want: time.Second},
+		{span: time.Hour, want: 30 * time.Second},
+		{span: 1000 * time.Hour, want: 5*time.Hour + time.Second},
+		{span: time.Hour, interval: 10 * time.Second, want: 10 * time.Second},
+		// 点数过多时改为自动选择
+		{span: 24 * time.Hour, interval: time.Millisecond, want: 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		got := chartInterval(tt.span, tt.interval)
+		if got != tt.want {
+			t.Errorf("chartInterval(%s, %s) = %s，期望 %s", tt.span, tt.interval, got, tt.want)
+		}
+		if int(tt.span/got)+1 > htmlLimitPoints {
+			t.Errorf("chartInterval(%s, %s) 的点数超过 %d", tt.span, tt.interval, htmlLimitPoints)
+		}
+	}
+}
+
+func TestWriteHTMLReport(t *testing.T) {
+	var records []Record
+	for _, res := range testResults() {
+		records = append(records, NewRecord(res))
+	}
+	// 跨度很长的记录也不会生成过多的点
+	last := NewRecord(testResults()[0])
+	last.End = last.Start.Add(30 * 24 * time.Hour)
+	records = append(records, last)
+	var b bytes.Buffer
+	if err := WriteHTMLReport(&b, "test", records, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() > 2<<20 {
+		t.Errorf("报告大小为 %d 字节", b.Len())
+	}
+	for _, s := range []string{"<svg", "/eml/a", "550"} {
+		if !bytes.Contains(b.Bytes(), []byte(s)) {
+			t.Errorf("报告中没有 %s", s)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package sender
+
+import (
+	"context"
+	"sendmail/utils"
+	"sync"
+	"time"
+)
+
+// maxLimiterWait 单次等待令牌的最长时间，到达后按当前速率重新计算，也是负载曲线调整速率的间隔
+const maxLimiterWait = 100 * time.Millisecond
+
+// tokenBucket 令牌桶，每秒产生 rate 个令牌，最多积累 burst 个。
+// generated 为累计产生的令牌数，issued 为累计预订的令牌数，两者之差为桶中剩余的令牌，
+// 令牌不足时先预订，等到 generated 追上预订时的 issued 后再派发，因此速率变化能在等待期间生效
+type tokenBucket struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	generated float64
+	issued    float64
+	last      time.Time
+	// now 和 sleep 为当前时间和等待的实现，测试时替换为虚拟时钟
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) bool
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: burst, generated: burst, last: time.Now(), now: time.Now, sleep: sleepContext}
+}
+
+// refill 按经过的时间补充令牌，调用前需要持有锁
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.generated += elapsed.Seconds() * b.rate
+		if b.generated-b.issued > b.burst {
+			b.generated = b.issued + b.burst
+		}
+	}
+	b.last = now
+}
+
+// reserve 预订 n 个令牌，返回令牌全部产生时 generated 需要达到的值
+func (b *tokenBucket) reserve(n float64) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(b.now())
+	b.issued += n
+	return b.issued
+}
+
+// until 返回 generated 达到 target 还需要等待的时长，最长为 maxLimiterWait
+func (b *tokenBucket) until(target float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(b.now())
+	if b.generated >= target {
+		return 0
+	}
+	if b.rate <= 0 {
+		return maxLimiterWait
+	}
+	wait := time.Duration((target - b.generated) / b.rate * float64(time.Second))
+	if wait > maxLimiterWait {
+		wait = maxLimiterWait
+	}
+	if wait <= 0 {
+		wait = time.Microsecond
+	}
+	return wait
+}
+
+// wait 等待取出 n 个令牌，ctx 取消时返回 false
+func (b *tokenBucket) wait(ctx context.Context, n float64) bool {
+	target := b.reserve(n)
+	for {
+		wait := b.until(target)
+		if wait == 0 {
+			return ctx.Err() == nil
+		}
+		if !b.sleep(ctx, wait) {
+			return false
+		}
+	}
+}
+
+// setRate 修改令牌产生速率，已经积累的令牌保留
+func (b *tokenBucket) setRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(b.now())
+	b.rate = rate
+}
+
+func (b *tokenBucket) currentRate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// limiter 按邮件数和字节数限制派发速率，所有工作协程共用
+type limiter struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+// newLimiter 没有设置速率和负载曲线时返回 nil
+func (e *Engine) newLimiter() *limiter {
+	if e.cfg.Rate <= 0 && e.cfg.ByteRate <= 0 && len(e.cfg.Profile) == 0 {
+		return nil
+	}
+	l := &limiter{}
+	if len(e.cfg.Profile) > 0 {
+		// 速率由负载曲线在运行时调整
+		_, rate, _ := e.cfg.Profile.At(0)
+		l.messages = newTokenBucket(rate, float64(e.cfg.Burst))
+	} else if e.cfg.Rate > 0 {
+		l.messages = newTokenBucket(e.cfg.Rate, float64(e.cfg.Burst))
+	}
+	if e.cfg.ByteRate > 0 {
+		burst := float64(e.cfg.ByteBurst)
+		if burst <= 0 {
+			burst = e.cfg.ByteRate
+		}
+		l.bytes = newTokenBucket(e.cfg.ByteRate, burst)
+	}
+	return l
+}
+
+// rate 返回当前每秒派发的邮件数，没有限制时为0
+func (l *limiter) rate() float64 {
+	if l == nil || l.messages == nil {
+		return 0
+	}
+	return l.messages.currentRate()
+}
+
+// wait 等待到该邮件可以派发，ctx 取消时返回 false
+func (l *limiter) wait(ctx context.Context, msg *utils.Message) bool {
+	if l == nil {
+		return ctx.Err() == nil
+	}
+	if l.messages != nil && !l.messages.wait(ctx, 1) {
+		return false
+	}
+	return l.waitBytes(ctx, msg)
+}
+
+// waitBytes 只按字节数等待，开放模型的邮件数由到达时间控制
+func (l *limiter) waitBytes(ctx context.Context, msg *utils.Message) bool {
+	if l == nil || l.bytes == nil {
+		return ctx.Err() == nil
+	}
+	return l.bytes.wait(ctx, float64(len(msg.Content)))
+}
@@ -0,0 +1,134 @@
+package sender
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock 虚拟时钟，sleep 不真正等待而是直接推进时间
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+func (c *fakeClock) sleep(ctx context.Context, d time.Duration) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	c.advance(d)
+	return true
+}
+
+// use 让令牌桶使用虚拟时钟
+func (c *fakeClock) use(b *tokenBucket) *tokenBucket {
+	b.last, b.now, b.sleep = c.now(), c.now, c.sleep
+	return b
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst float64
+		// reserved 预先预订的令牌数，idle 为之后经过的时间
+		reserved float64
+		idle     time.Duration
+		n        float64
+		// want 为 until 返回的等待时长
+		want time.Duration
+	}{
+		{name: "burst available", rate: 10, burst: 3, reserved: 2, n: 1, want: 0},
+		{name: "burst exhausted", rate: 100, burst: 1, reserved: 1, n: 1, want: 10 * time.Millisecond},
+		{name: "wait capped", rate: 1, burst: 1, reserved: 1, n: 1, want: maxLimiterWait},
+		{name: "zero rate", rate: 0, burst: 1, reserved: 1, n: 1, want: maxLimiterWait},
+		// 晚醒来时已经产生的令牌不会丢失
+		{name: "late wakeup keeps tokens", rate: 100, burst: 1, reserved: 5, idle: 100 * time.Millisecond, n: 1, want: 0},
+		{name: "partially refilled", rate: 100, burst: 1, reserved: 2, idle: 5 * time.Millisecond, n: 1, want: 15 * time.Millisecond},
+		// 空闲时积累的令牌不超过 burst
+		{name: "idle capped at burst", rate: 100, burst: 2, reserved: 0, idle: time.Second, n: 3, want: 10 * time.Millisecond},
+		{name: "burst below one", rate: 10, burst: 0, reserved: 0, n: 1, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			b := clock.use(newTokenBucket(tt.rate, tt.burst))
+			if tt.reserved > 0 {
+				b.reserve(tt.reserved)
+			}
+			clock.advance(tt.idle)
+			target := b.reserve(tt.n)
+			if wait := b.until(target); !durationNear(wait, tt.want) {
+				t.Fatalf("until = %s，期望 %s", wait, tt.want)
+			}
+		})
+	}
+}
+
+// durationNear 比较等待时长，允许浮点计算带来的微秒级误差
+func durationNear(got, want time.Duration) bool {
+	diff := got - want
+	return diff > -time.Microsecond && diff < time.Microsecond
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	clock := newFakeClock()
+	b := clock.use(newTokenBucket(0, 1))
+	target := b.reserve(2)
+	if wait := b.until(target); wait != maxLimiterWait {
+		t.Fatalf("速率为0时 until = %s", wait)
+	}
+	// 等待期间提高速率后按新速率计算
+	clock.advance(maxLimiterWait)
+	b.setRate(1000)
+	if wait := b.until(target); !durationNear(wait, time.Millisecond) {
+		t.Fatalf("提高速率后 until = %s", wait)
+	}
+	if rate := b.currentRate(); rate != 1000 {
+		t.Fatalf("currentRate = %g", rate)
+	}
+}
+
+func TestTokenBucketWaitRate(t *testing.T) {
+	const rate, n = 200, 40
+	clock := newFakeClock()
+	b := clock.use(newTokenBucket(rate, 1))
+	start := clock.now()
+	for i := 0; i < n; i++ {
+		if !b.wait(context.Background(), 1) {
+			t.Fatal("wait 返回 false")
+		}
+	}
+	// 第一个令牌来自 burst，其余按速率产生
+	want := time.Duration(float64(n-1) / rate * float64(time.Second))
+	if elapsed := clock.now().Sub(start); elapsed < want || elapsed > want+n*time.Microsecond {
+		t.Fatalf("取出 %d 个令牌耗时 %s，期望 %s", n, elapsed, want)
+	}
+}
+
+func TestTokenBucketWaitCanceled(t *testing.T) {
+	b := newTokenBucket(0, 1)
+	b.reserve(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if b.wait(ctx, 1) {
+		t.Fatal("ctx 取消后 wait 应返回 false")
+	}
+}
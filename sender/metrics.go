@@ -0,0 +1,209 @@
+package sender
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricBuckets 耗时直方图的桶上界，单位为秒
+var metricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metricErrorClasses 除 ok、deferred、rejected 外的结果分类，没有发生过的分类也输出0
+var metricErrorClasses = []string{ClassDNS, ClassConnect, ClassTLS, ClassTimeout, ClassConnection, ClassSource, ClassDropped}
+
+// promHistogram Prometheus格式的累积直方图，counts 为每个桶内（不累积）的次数，最后一个为 +Inf
+type promHistogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newPromHistogram() *promHistogram {
+	return &promHistogram{counts: make([]uint64, len(metricBuckets)+1)}
+}
+
+func (h *promHistogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.counts[sort.SearchFloat64s(metricBuckets, v)]++
+	h.sum += v
+	h.count++
+}
+
+// write 输出直方图的所有序列，labels 为其他标签，格式如 phase="mail",
+func (h *promHistogram) write(b *bytes.Buffer, name, labels string) {
+	var cumulative uint64
+	for i, le := range metricBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	labels = trimLabels(labels)
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// trimLabels 将 write 使用的标签转换为完整的标签部分，没有标签时为空
+func trimLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels[:len(labels)-1] + "}"
+}
+
+// labelEscaper 按Prometheus文本格式转义标签值，只转义反斜杠、双引号和换行
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label 返回 name="value" 形式的标签
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+// Metrics 发件引擎的运行指标，通过 ServeHTTP 以Prometheus文本格式输出，
+// 设置到 Config.Metrics 后由引擎在发送过程中更新，nil 时不记录
+type Metrics struct {
+	mu       sync.Mutex
+	sent     uint64
+	accepted uint64
+	deferred uint64
+	rejected uint64
+	bytes    uint64
+	errors   map[string]uint64
+	// rcptAccepted 和 rcptRejected 为收件人数
+	rcptAccepted uint64
+	rcptRejected uint64
+	inFlight     int64
+	connections  int64
+	// latency 为成功邮件的发送耗时，phases 为各阶段的耗时
+	latency *promHistogram
+	phases  map[string]*promHistogram
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{errors: map[string]uint64{}, latency: newPromHistogram(), phases: map[string]*promHistogram{}}
+	for _, phase := range (Timings{}).Phases() {
+		m.phases[phase.Name] = newPromHistogram()
+	}
+	return m
+}
+
+// begin 开始发送一封邮件
+func (m *Metrics) begin() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight++
+}
+
+// finish 一封邮件发送结束，与 begin 成对调用
+func (m *Metrics) finish(r *Result) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.add(r)
+}
+
+// observe 记录没有经过发送的结果，如读取来源失败或开放模型中放弃发送的邮件
+func (m *Metrics) observe(r *Result) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(r)
+}
+
+// connOpened 和 connClosed 在SMTP连接建立和关闭时调用
+func (m *Metrics) connOpened() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections++
+}
+
+func (m *Metrics) connClosed() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connections--
+}
+
+// add 记录一封邮件的结果，调用前需要持有锁
+func (m *Metrics) add(r *Result) {
+	if r.Stage != StageSource && r.Stage != StageDropped {
+		m.sent++
+	}
+	switch class := r.ErrorClass(); class {
+	case ClassOK:
+		m.accepted++
+		m.bytes += uint64(r.Size)
+		m.latency.observe(r.Duration)
+	case ClassDeferred:
+		m.deferred++
+	case ClassRejected:
+		m.rejected++
+	default:
+		m.errors[class]++
+	}
+	for _, rcpt := range r.Rcpts {
+		if rcpt.Accepted() {
+			m.rcptAccepted++
+		} else {
+			m.rcptRejected++
+		}
+	}
+	for _, phase := range r.Timings.Phases() {
+		if phase.Duration > 0 {
+			m.phases[phase.Name].observe(phase.Duration)
+		}
+	}
+}
+
+// ServeHTTP 以Prometheus文本格式输出所有指标
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	var b bytes.Buffer
+	m.mu.Lock()
+	counter := func(name, help string, value uint64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge := func(name, help string, value int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+	}
+	counter("sendmail_messages_sent_total", "已派发并结束发送的邮件数，包括失败的邮件", m.sent)
+	counter("sendmail_messages_accepted_total", "服务器接受的邮件数", m.accepted)
+	counter("sendmail_messages_deferred_total", "服务器返回4xx临时错误的邮件数", m.deferred)
+	counter("sendmail_messages_rejected_total", "服务器返回5xx拒绝的邮件数", m.rejected)
+	counter("sendmail_accepted_bytes_total", "服务器接受的邮件字节数", m.bytes)
+	b.WriteString("# HELP sendmail_errors_total 没有收到服务器响应的失败邮件数，按错误所在的环节分类\n# TYPE sendmail_errors_total counter\n")
+	for _, class := range metricErrorClasses {
+		fmt.Fprintf(&b, "sendmail_errors_total{%s} %d\n", label("class", class), m.errors[class])
+	}
+	b.WriteString("# HELP sendmail_recipients_total 收件人数，按服务器是否接受分类\n# TYPE sendmail_recipients_total counter\n")
+	fmt.Fprintf(&b, "sendmail_recipients_total{%s} %d\n", label("result", "accepted"), m.rcptAccepted)
+	fmt.Fprintf(&b, "sendmail_recipients_total{%s} %d\n", label("result", "rejected"), m.rcptRejected)
+	gauge("sendmail_messages_in_flight", "正在发送的邮件数", m.inFlight)
+	gauge("sendmail_connections_open", "当前打开的SMTP连接数", m.connections)
+	b.WriteString("# HELP sendmail_send_duration_seconds 成功邮件的发送耗时\n# TYPE sendmail_send_duration_seconds histogram\n")
+	m.latency.write(&b, "sendmail_send_duration_seconds", "")
+	b.WriteString("# HELP sendmail_phase_duration_seconds 发送各阶段的耗时\n# TYPE sendmail_phase_duration_seconds histogram\n")
+	for _, phase := range (Timings{}).Phases() {
+		m.phases[phase.Name].write(&b, "sendmail_phase_duration_seconds", label("phase", phase.Name)+",")
+	}
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,283 @@
+package sender
+
+import (
+	"errors"
+	"math"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// promSample 指标输出中的一个样本
+type promSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// parseLabels 解析 {a="x",b="y"} 中的标签，按Prometheus文本格式还原转义
+func parseLabels(t *testing.T, s string) map[string]string {
+	t.Helper()
+	labels := map[string]string{}
+	for s != "" {
+		name, rest, ok := strings.Cut(s, `="`)
+		if !ok {
+			t.Fatalf("标签格式错误：%s", s)
+		}
+		var value strings.Builder
+		i := 0
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			if rest[i] != '\\' {
+				value.WriteByte(rest[i])
+				continue
+			}
+			i++
+			if i == len(rest) {
+				t.Fatalf("标签值以反斜杠结尾：%s", s)
+			}
+			switch rest[i] {
+			case '\\', '"':
+				value.WriteByte(rest[i])
+			case 'n':
+				value.WriteByte('\n')
+			default:
+				t.Fatalf("标签值中有不支持的转义 \\%c：%s", rest[i], s)
+			}
+		}
+		if i == len(rest) {
+			t.Fatalf("标签值没有结束的引号：%s", s)
+		}
+		labels[name] = value.String()
+		s = strings.TrimPrefix(rest[i+1:], ",")
+	}
+	return labels
+}
+
+// scrapeMetrics 请求 ServeHTTP 并解析输出，同时检查每个指标前都有 HELP 和 TYPE，返回样本和指标类型
+func scrapeMetrics(t *testing.T, m *Metrics) ([]promSample, map[string]string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type 为 %s", ct)
+	}
+	types := map[string]string{}
+	var samples []promSample
+	var help, family string
+	for _, line := range strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) != 4 || fields[3] == "" {
+				t.Fatalf("HELP 行格式错误：%s", line)
+			}
+			help = fields[2]
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 || fields[2] != help {
+				t.Fatalf("TYPE 行前没有对应的 HELP 行：%s", line)
+			}
+			if _, ok := types[fields[2]]; ok {
+				t.Fatalf("指标 %s 重复声明", fields[2])
+			}
+			family = fields[2]
+			types[family] = fields[3]
+			continue
+		}
+		series, value, ok := strings.Cut(line, " ")
+		if !ok {
+			t.Fatalf("样本格式错误：%s", line)
+		}
+		sample := promSample{name: series, labels: map[string]string{}}
+		if name, labels, ok := strings.Cut(series, "{"); ok {
+			if !strings.HasSuffix(labels, "}") {
+				t.Fatalf("样本的标签没有结束：%s", line)
+			}
+			sample.name = name
+			sample.labels = parseLabels(t, strings.TrimSuffix(labels, "}"))
+		}
+		var err error
+		if sample.value, err = strconv.ParseFloat(value, 64); err != nil {
+			t.Fatalf("样本的值格式错误：%s", line)
+		}
+		base := sample.name
+		if types[family] == "histogram" {
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				base = strings.TrimSuffix(base, suffix)
+			}
+		}
+		if base != family {
+			t.Fatalf("样本 %s 不属于之前声明的指标 %s", sample.name, family)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, types
+}
+
+// findSample 返回名称和标签都匹配的样本的值
+func findSample(t *testing.T, samples []promSample, name string, labels map[string]string) float64 {
+	t.Helper()
+	for _, s := range samples {
+		if s.name != name || len(s.labels) != len(labels) {
+			continue
+		}
+		match := true
+		for k, v := range labels {
+			if s.labels[k] != v {
+				match = false
+			}
+		}
+		if match {
+			return s.value
+		}
+	}
+	t.Fatalf("没有找到样本 %s%v", name, labels)
+	return 0
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	m := NewMetrics()
+	m.begin()
+	m.finish(&Result{Size: 100, Duration: 20 * time.Millisecond, Timings: Timings{Connect: 3 * time.Millisecond, Data: 2 * time.Second},
+		Rcpts: []RcptResult{{Addr: "a@example.com", Code: 250}, {Addr: "b@example.com", Code: 250}, {Addr: "c@example.com", Code: 550}}})
+	m.begin()
+	m.finish(&Result{Size: 200, Duration: 700 * time.Millisecond, Timings: Timings{Connect: 40 * time.Millisecond}})
+	m.begin()
+	m.finish(&Result{Stage: StageRcpt, Err: &textproto.Error{Code: 451, Msg: "try later"}})
+	m.observe(&Result{Stage: StageSource, Err: errors.New("读取失败")})
+	m.begin()
+	m.connOpened()
+
+	samples, types := scrapeMetrics(t, m)
+	for name, want := range map[string]string{
+		"sendmail_messages_sent_total":     "counter",
+		"sendmail_errors_total":            "counter",
+		"sendmail_messages_in_flight":      "gauge",
+		"sendmail_send_duration_seconds":   "histogram",
+		"sendmail_phase_duration_seconds":  "histogram",
+		"sendmail_recipients_total":        "counter",
+		"sendmail_messages_accepted_total": "counter",
+	} {
+		if types[name] != want {
+			t.Errorf("%s 的类型为 %q，期望 %s", name, types[name], want)
+		}
+	}
+	for _, tt := range []struct {
+		name   string
+		labels map[string]string
+		want   float64
+	}{
+		{"sendmail_messages_sent_total", nil, 3},
+		{"sendmail_messages_accepted_total", nil, 2},
+		{"sendmail_messages_deferred_total", nil, 1},
+		{"sendmail_messages_rejected_total", nil, 0},
+		{"sendmail_accepted_bytes_total", nil, 300},
+		{"sendmail_errors_total", map[string]string{"class": ClassSource}, 1},
+		{"sendmail_errors_total", map[string]string{"class": ClassConnect}, 0},
+		{"sendmail_recipients_total", map[string]string{"result": "accepted"}, 2},
+		{"sendmail_recipients_total", map[string]string{"result": "rejected"}, 1},
+		{"sendmail_messages_in_flight", nil, 1},
+		{"sendmail_connections_open", nil, 1},
+		{"sendmail_send_duration_seconds_bucket", map[string]string{"le": "0.01"}, 0},
+		{"sendmail_send_duration_seconds_bucket", map[string]string{"le": "0.025"}, 1},
+		{"sendmail_send_duration_seconds_bucket", map[string]string{"le": "1"}, 2},
+		{"sendmail_phase_duration_seconds_count", map[string]string{"phase": "connect"}, 2},
+		{"sendmail_phase_duration_seconds_bucket", map[string]string{"phase": "data", "le": "1"}, 0},
+		{"sendmail_phase_duration_seconds_bucket", map[string]string{"phase": "data", "le": "2.5"}, 1},
+		{"sendmail_phase_duration_seconds_count", map[string]string{"phase": "tls"}, 0},
+	} {
+		if got := findSample(t, samples, tt.name, tt.labels); got != tt.want {
+			t.Errorf("%s%v = %g，期望 %g", tt.name, tt.labels, got, tt.want)
+		}
+	}
+	sums := map[string]float64{
+		"sendmail_send_duration_seconds":                 0.72,
+		"sendmail_phase_duration_seconds{phase=connect}": 0.043,
+		"sendmail_phase_duration_seconds{phase=data}":    2,
+	}
+	checkHistograms(t, samples, types, sums)
+}
+
+// checkHistograms 检查每个直方图序列的桶按 le 递增且累积，+Inf 桶等于 _count，_sum 等于 sums 中的期望值
+func checkHistograms(t *testing.T, samples []promSample, types map[string]string, sums map[string]float64) {
+	t.Helper()
+	type series struct {
+		les      []float64
+		buckets  []float64
+		sum      float64
+		count    float64
+		hasSum   bool
+		hasCount bool
+	}
+	all := map[string]*series{}
+	var keys []string
+	for _, s := range samples {
+		base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(s.name, "_bucket"), "_sum"), "_count")
+		if types[base] != "histogram" {
+			continue
+		}
+		key := base
+		if phase, ok := s.labels["phase"]; ok {
+			key += "{phase=" + phase + "}"
+		}
+		h := all[key]
+		if h == nil {
+			h = &series{}
+			all[key] = h
+			keys = append(keys, key)
+		}
+		switch s.name {
+		case base + "_bucket":
+			le, err := strconv.ParseFloat(s.labels["le"], 64)
+			if err != nil {
+				t.Fatalf("%s 的 le 格式错误：%q", key, s.labels["le"])
+			}
+			h.les = append(h.les, le)
+			h.buckets = append(h.buckets, s.value)
+		case base + "_sum":
+			h.sum, h.hasSum = s.value, true
+		case base + "_count":
+			h.count, h.hasCount = s.value, true
+		}
+	}
+	for _, key := range keys {
+		h := all[key]
+		if len(h.les) != len(metricBuckets)+1 || !h.hasSum || !h.hasCount {
+			t.Errorf("%s 的序列不完整：%d 个桶，sum %v，count %v", key, len(h.les), h.hasSum, h.hasCount)
+			continue
+		}
+		for i := 1; i < len(h.les); i++ {
+			if h.les[i] <= h.les[i-1] || h.buckets[i] < h.buckets[i-1] {
+				t.Errorf("%s 的第 %d 个桶 le=%g %g 没有递增", key, i, h.les[i], h.buckets[i])
+			}
+		}
+		if last := len(h.les) - 1; !math.IsInf(h.les[last], 1) || h.buckets[last] != h.count {
+			t.Errorf("%s 的最后一个桶 le=%g %g，_count 为 %g", key, h.les[last], h.buckets[last], h.count)
+		}
+		if h.count == 0 && h.sum != 0 {
+			t.Errorf("%s 没有样本但 _sum 为 %g", key, h.sum)
+		}
+		if want, ok := sums[key]; ok && math.Abs(h.sum-want) > 1e-9 {
+			t.Errorf("%s 的 _sum 为 %g，期望 %g", key, h.sum, want)
+		}
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	value := "a\"b\\c\nd"
+	got := label("class", value)
+	if want := `class="a\"b\\c\nd"`; got != want {
+		t.Fatalf("label = %s，期望 %s", got, want)
+	}
+	if labels := parseLabels(t, got+`,le="+Inf"`); labels["class"] != value || labels["le"] != "+Inf" {
+		t.Fatalf("解析转义后的标签为 %q", labels)
+	}
+	// 非ASCII字符原样输出，不使用Go的 \u 转义
+	if got := label("phase", "阶段"); got != `phase="阶段"` {
+		t.Fatalf("label = %s", got)
+	}
+}
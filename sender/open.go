@@ -0,0 +1,111 @@
+package sender
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sendmail/utils"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 开放模型的到达间隔分布
+const (
+	ArrivalPoisson = "poisson"
+	ArrivalFixed   = "fixed"
+)
+
+// lateThreshold 实际派发时间晚于计划时间超过该时长时记为迟到
+const lateThreshold = 10 * time.Millisecond
+
+var errDropped = errors.New("进行中的邮件数达到上限，放弃本次发送")
+
+// arrivals 按速率生成开放模型的计划派发时间
+type arrivals struct {
+	poisson bool
+	rnd     *rand.Rand
+	next    time.Time
+}
+
+func newArrivals(kind string) *arrivals {
+	return &arrivals{poisson: kind != ArrivalFixed, rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// schedule 返回下一次派发的计划时间，rate 返回当前的速率，速率为0时等待速率变化，ctx 取消时返回 false
+func (a *arrivals) schedule(ctx context.Context, rate func() float64) (time.Time, bool) {
+	for {
+		r := rate()
+		if r > 0 {
+			interval := 1 / r
+			if a.poisson {
+				interval = a.rnd.ExpFloat64() / r
+			}
+			if a.next.IsZero() {
+				a.next = time.Now()
+			}
+			a.next = a.next.Add(time.Duration(interval * float64(time.Second)))
+			return a.next, true
+		}
+		// 速率为0期间不积累到达
+		a.next = time.Time{}
+		if !sleepContext(ctx, maxLimiterWait) {
+			return time.Time{}, false
+		}
+	}
+}
+
+// dispatchOpen 按开放模型派发邮件：到达计划时间即新建协程发送，不等待之前的邮件完成，
+// 进行中的邮件数达到 MaxInFlight 时放弃本次发送
+func (e *Engine) dispatchOpen(ctx context.Context, src utils.Source, results chan<- *Result) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var inFlight int64
+	var faithful *faithfulPacer
+	if e.cfg.Faithful {
+		faithful = e.newFaithfulPacer()
+		defer faithful.close()
+	}
+	arrive := newArrivals(e.cfg.Arrival)
+	for {
+		var due time.Time
+		if faithful == nil {
+			var ok bool
+			if due, ok = arrive.schedule(ctx, e.limiter.rate); !ok {
+				return
+			}
+		}
+		msg, ok := e.next(ctx, src, results)
+		if !ok {
+			return
+		}
+		if faithful != nil {
+			due = faithful.due(msg)
+		}
+		// 设置了 ByteRate 时超出字节速率的邮件推迟派发，推迟的时间计入 Late
+		if !sleepContext(ctx, time.Until(due)) || !e.limiter.waitBytes(ctx, msg) {
+			return
+		}
+		var late time.Duration
+		if !due.IsZero() {
+			late = time.Since(due)
+		}
+		if e.cfg.MaxInFlight > 0 && atomic.LoadInt64(&inFlight) >= int64(e.cfg.MaxInFlight) {
+			res := &Result{Path: msg.Path, Size: len(msg.Content), Start: time.Now(), LoadStage: e.loadStage(), Late: late, Stage: StageDropped, Err: errDropped}
+			e.cfg.Metrics.observe(res)
+			results <- res
+			continue
+		}
+		atomic.AddInt64(&inFlight, 1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := &worker{e: e}
+			res := w.deliver(msg)
+			w.closeSession()
+			atomic.AddInt64(&inFlight, -1)
+			res.Late = late
+			results <- res
+		}()
+	}
+}
@@ -0,0 +1,110 @@
+package sender
+
+import (
+	"context"
+	"sendmail/utils"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pacer 决定每封邮件的派发时间
+type pacer interface {
+	// wait 等待到该邮件可以派发，ctx 取消时返回 false
+	wait(ctx context.Context, msg *utils.Message) bool
+	// close 派发结束时调用
+	close()
+}
+
+func (e *Engine) newPacer() pacer {
+	if e.cfg.Faithful {
+		return e.newFaithfulPacer()
+	}
+	return sleepPacer(e.cfg.Sleep)
+}
+
+func (e *Engine) newFaithfulPacer() *faithfulPacer {
+	speed := e.cfg.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+	return &faithfulPacer{speed: speed, maxGap: e.cfg.MaxGap, now: time.Now}
+}
+
+// sleepPacer 每封邮件派发前等待固定的时间
+type sleepPacer time.Duration
+
+func (p sleepPacer) wait(ctx context.Context, msg *utils.Message) bool {
+	return sleepContext(ctx, time.Duration(p))
+}
+
+func (p sleepPacer) close() {}
+
+// faithfulPacer 按邮件原始到达时间之间的间隔派发，要求来源按到达时间升序返回邮件，
+// 派发时间以第一封邮件为起点计算，工作协程繁忙造成的延迟不会累积到后续的间隔中
+type faithfulPacer struct {
+	speed  float64
+	maxGap time.Duration
+	now    func() time.Time
+	// start 第一封邮件的派发时间，offset 当前邮件相对 start 的计划派发时间
+	start  time.Time
+	offset time.Duration
+	// last 已经派发的邮件中最晚的到达时间
+	last time.Time
+	// outOfOrder 到达时间早于之前邮件的邮件数，这些邮件无法还原原始间隔
+	outOfOrder int
+}
+
+func (p *faithfulPacer) wait(ctx context.Context, msg *utils.Message) bool {
+	return sleepContext(ctx, p.due(msg).Sub(p.now()))
+}
+
+// close 输出乱序的邮件数
+func (p *faithfulPacer) close() {
+	if p.outOfOrder > 0 {
+		log.Warnf("到达时间乱序的邮件数：%d 封，这些邮件没有按原始间隔派发", p.outOfOrder)
+	}
+}
+
+// due 返回邮件的计划派发时间，没有到达时间的邮件返回零值表示立即派发
+func (p *faithfulPacer) due(msg *utils.Message) time.Time {
+	if msg.Timestamp.IsZero() {
+		return time.Time{}
+	}
+	if p.last.IsZero() {
+		p.start = p.now()
+		p.last = msg.Timestamp
+		return p.start
+	}
+	if msg.Timestamp.Before(p.last) {
+		// 到达时间早于之前的邮件时不等待，与上一封邮件同时派发
+		if p.outOfOrder == 0 {
+			log.Warnf("邮件 %s 的到达时间 %s 早于之前的邮件 %s，按原始间隔重放要求来源按到达时间排序",
+				msg.Path, msg.Timestamp.Format(time.RFC3339), p.last.Format(time.RFC3339))
+		}
+		p.outOfOrder++
+	} else if gap := msg.Timestamp.Sub(p.last); gap > 0 {
+		scaled := time.Duration(float64(gap) / p.speed)
+		if p.maxGap > 0 && scaled > p.maxGap {
+			scaled = p.maxGap
+		}
+		p.offset += scaled
+		p.last = msg.Timestamp
+	}
+	return p.start.Add(p.offset)
+}
+
+// sleepContext 等待 d 时长，ctx 取消时返回 false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
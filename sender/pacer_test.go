@@ -0,0 +1,87 @@
+package sender
+
+import (
+	"sendmail/utils"
+	"testing"
+	"time"
+)
+
+func TestFaithfulPacerDue(t *testing.T) {
+	base := time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *utils.Message {
+		return &utils.Message{Path: d.String(), Timestamp: base.Add(d)}
+	}
+	none := &utils.Message{Path: "none"}
+	tests := []struct {
+		name   string
+		speed  float64
+		maxGap time.Duration
+		msgs   []*utils.Message
+		// want 为每封邮件的计划派发时间相对第一封邮件的偏移，-1 表示立即派发
+		want       []time.Duration
+		outOfOrder int
+	}{
+		{
+			name:  "original gaps",
+			speed: 1,
+			msgs:  []*utils.Message{at(0), at(time.Second), at(time.Second), at(5 * time.Second)},
+			want:  []time.Duration{0, time.Second, time.Second, 5 * time.Second},
+		},
+		{
+			name:  "speed",
+			speed: 10,
+			msgs:  []*utils.Message{at(time.Minute), at(2 * time.Minute), at(12 * time.Minute)},
+			want:  []time.Duration{0, 6 * time.Second, 66 * time.Second},
+		},
+		{
+			name:  "slow motion",
+			speed: 0.5,
+			msgs:  []*utils.Message{at(0), at(time.Second)},
+			want:  []time.Duration{0, 2 * time.Second},
+		},
+		{
+			// 缩放后的间隔超过 maxGap 时按 maxGap 等待
+			name:   "max gap",
+			speed:  2,
+			maxGap: 5 * time.Second,
+			msgs:   []*utils.Message{at(0), at(4 * time.Second), at(time.Hour), at(time.Hour + 20*time.Second)},
+			want:   []time.Duration{0, 2 * time.Second, 7 * time.Second, 12 * time.Second},
+		},
+		{
+			// 没有到达时间的邮件立即派发，不影响之后的间隔
+			name:  "zero timestamps",
+			speed: 1,
+			msgs:  []*utils.Message{none, at(0), none, at(3 * time.Second)},
+			want:  []time.Duration{-1, 0, -1, 3 * time.Second},
+		},
+		{
+			// 乱序的邮件与之前最晚的邮件同时派发，之后的间隔从最晚的到达时间计算
+			name:       "out of order",
+			speed:      1,
+			msgs:       []*utils.Message{at(0), at(10 * time.Second), at(2 * time.Second), at(5 * time.Second), at(12 * time.Second)},
+			want:       []time.Duration{0, 10 * time.Second, 10 * time.Second, 10 * time.Second, 12 * time.Second},
+			outOfOrder: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+			p := &faithfulPacer{speed: tt.speed, maxGap: tt.maxGap, now: func() time.Time { return start }}
+			for i, msg := range tt.msgs {
+				due := p.due(msg)
+				if tt.want[i] < 0 {
+					if !due.IsZero() {
+						t.Errorf("第%d封邮件的派发时间为 %s，期望立即派发", i+1, due)
+					}
+					continue
+				}
+				if got := due.Sub(start); got != tt.want[i] {
+					t.Errorf("第%d封邮件的派发时间为 +%s，期望 +%s", i+1, got, tt.want[i])
+				}
+			}
+			if p.outOfOrder != tt.outOfOrder {
+				t.Errorf("乱序的邮件数为 %d，期望 %d", p.outOfOrder, tt.outOfOrder)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package sender
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 负载阶段的类型
+const (
+	ProfileRamp  = "ramp"
+	ProfileStep  = "step"
+	ProfileSpike = "spike"
+	ProfileSoak  = "soak"
+)
+
+// ProfileStage 负载曲线中的一个阶段
+type ProfileStage struct {
+	// Name 阶段名称，为序号加阶段定义，如 1:ramp:10:100:5m
+	Name string
+	Kind string
+	// From 和 To 为阶段开始和结束时的速率，单位为 封/秒，Step 为 step 阶段每次增加的速率
+	From float64
+	To   float64
+	Step float64
+	// Duration 阶段持续时间，StepDuration 为 step 阶段每一级的持续时间
+	Duration     time.Duration
+	StepDuration time.Duration
+}
+
+// rate 返回阶段开始 elapsed 之后的速率
+func (s ProfileStage) rate(elapsed time.Duration) float64 {
+	switch s.Kind {
+	case ProfileRamp:
+		if s.Duration <= 0 {
+			return s.To
+		}
+		return s.From + (s.To-s.From)*float64(elapsed)/float64(s.Duration)
+	case ProfileStep:
+		rate := s.From + s.Step*float64(elapsed/s.StepDuration)
+		if (s.Step > 0 && rate > s.To) || (s.Step < 0 && rate < s.To) {
+			rate = s.To
+		}
+		return rate
+	default:
+		return s.From
+	}
+}
+
+// Profile 负载曲线，各阶段依次执行
+type Profile []ProfileStage
+
+// Duration 负载曲线的总时长
+func (p Profile) Duration() time.Duration {
+	var total time.Duration
+	for _, stage := range p {
+		total += stage.Duration
+	}
+	return total
+}
+
+// At 返回开始 elapsed 之后所处的阶段和速率，超过总时长时返回 false
+func (p Profile) At(elapsed time.Duration) (ProfileStage, float64, bool) {
+	for _, stage := range p {
+		if elapsed < stage.Duration {
+			return stage, stage.rate(elapsed), true
+		}
+		elapsed -= stage.Duration
+	}
+	return ProfileStage{}, 0, false
+}
+
+// ParseProfile 解析负载曲线，多个阶段以逗号分隔，速率单位为 封/秒，支持的阶段为
+//
+//	ramp:起始速率:结束速率:时长     在时长内线性地从起始速率变化到结束速率
+//	step:起始速率:结束速率:增量:每级时长  每级时长增加一次速率，直到结束速率
+//	spike:速率:时长               短时间的突发流量
+//	soak:速率:时长                长时间保持恒定速率
+func ParseProfile(spec string) (Profile, error) {
+	var profile Profile
+	for i, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		stage, err := parseProfileStage(item)
+		if err != nil {
+			return nil, fmt.Errorf("负载阶段 %s 格式错误：%v", item, err)
+		}
+		stage.Name = strconv.Itoa(i+1) + ":" + item
+		profile = append(profile, stage)
+	}
+	if len(profile) == 0 {
+		return nil, fmt.Errorf("负载曲线为空")
+	}
+	return profile, nil
+}
+
+func parseProfileStage(item string) (ProfileStage, error) {
+	fields := strings.Split(item, ":")
+	stage := ProfileStage{Kind: fields[0]}
+	want := map[string]int{ProfileRamp: 4, ProfileStep: 5, ProfileSpike: 3, ProfileSoak: 3}[stage.Kind]
+	if want == 0 {
+		return stage, fmt.Errorf("不支持的阶段类型 %s", stage.Kind)
+	}
+	if len(fields) != want {
+		return stage, fmt.Errorf("%s 需要 %d 个参数", stage.Kind, want-1)
+	}
+	var rates []float64
+	for _, field := range fields[1 : want-1] {
+		rate, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return stage, err
+		}
+		if rate < 0 {
+			return stage, fmt.Errorf("速率不能小于0")
+		}
+		rates = append(rates, rate)
+	}
+	duration, err := time.ParseDuration(fields[want-1])
+	if err != nil {
+		return stage, err
+	}
+	if duration <= 0 {
+		return stage, fmt.Errorf("时长必须大于0")
+	}
+	switch stage.Kind {
+	case ProfileRamp:
+		stage.From, stage.To, stage.Duration = rates[0], rates[1], duration
+	case ProfileStep:
+		if rates[2] == 0 {
+			return stage, fmt.Errorf("增量不能为0")
+		}
+		stage.From, stage.To, stage.Step, stage.StepDuration = rates[0], rates[1], rates[2], duration
+		if stage.Step < 0 {
+			stage.Step = -stage.Step
+		}
+		if stage.To < stage.From {
+			stage.Step = -stage.Step
+		}
+		// 每一级持续 StepDuration，最后一级为结束速率
+		steps := int((stage.To-stage.From)/stage.Step+0.999999) + 1
+		stage.Duration = time.Duration(steps) * duration
+	default:
+		stage.From, stage.To, stage.Duration = rates[0], rates[0], duration
+	}
+	return stage, nil
+}
@@ -0,0 +1,118 @@
+package sender
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseProfile(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Profile
+	}{
+		{
+			spec: "ramp:10:100:5m",
+			want: Profile{{Name: "1:ramp:10:100:5m", Kind: ProfileRamp, From: 10, To: 100, Duration: 5 * time.Minute}},
+		},
+		{
+			// 每级 1m，10、40、70、100 共4级
+			spec: "step:10:100:30:1m",
+			want: Profile{{Name: "1:step:10:100:30:1m", Kind: ProfileStep, From: 10, To: 100, Step: 30, StepDuration: time.Minute, Duration: 4 * time.Minute}},
+		},
+		{
+			// 增量不能整除时最后一级为结束速率：10、50、90、100
+			spec: "step:10:100:40:1m",
+			want: Profile{{Name: "1:step:10:100:40:1m", Kind: ProfileStep, From: 10, To: 100, Step: 40, StepDuration: time.Minute, Duration: 4 * time.Minute}},
+		},
+		{
+			// 结束速率低于起始速率时逐级降低
+			spec: "step:100:10:30:30s",
+			want: Profile{{Name: "1:step:100:10:30:30s", Kind: ProfileStep, From: 100, To: 10, Step: -30, StepDuration: 30 * time.Second, Duration: 2 * time.Minute}},
+		},
+		{
+			spec: " soak:50:1h , ,spike:500:30s",
+			want: Profile{
+				{Name: "1:soak:50:1h", Kind: ProfileSoak, From: 50, To: 50, Duration: time.Hour},
+				{Name: "3:spike:500:30s", Kind: ProfileSpike, From: 500, To: 500, Duration: 30 * time.Second},
+			},
+		},
+		{
+			spec: "soak:0.5:10s",
+			want: Profile{{Name: "1:soak:0.5:10s", Kind: ProfileSoak, From: 0.5, To: 0.5, Duration: 10 * time.Second}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseProfile(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseProfile(%q) = %+v，期望 %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProfileInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		" , ",
+		"burst:10:1m",
+		"ramp:10:100",
+		"ramp:10:100:5m:1m",
+		"soak:abc:1m",
+		"soak:-1:1m",
+		"soak:10:0s",
+		"soak:10:-1m",
+		"soak:10:5x",
+		"soak:10:60",
+		"step:10:100:0:1m",
+		"step:10:100:-10:1m",
+		"step:10:100:10:0s",
+		"ramp:10:100:5m,spike:1000",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			if profile, err := ParseProfile(spec); err == nil {
+				t.Fatalf("ParseProfile(%q) = %+v，期望返回错误", spec, profile)
+			}
+		})
+	}
+}
+
+func TestProfileAt(t *testing.T) {
+	profile, err := ParseProfile("ramp:0:100:10s,step:100:200:50:5s,spike:1000:1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		elapsed time.Duration
+		stage   string
+		rate    float64
+		ok      bool
+	}{
+		{elapsed: 0, stage: "1:ramp:0:100:10s", rate: 0, ok: true},
+		{elapsed: 5 * time.Second, stage: "1:ramp:0:100:10s", rate: 50, ok: true},
+		{elapsed: 10*time.Second - time.Millisecond, stage: "1:ramp:0:100:10s", rate: 99.99, ok: true},
+		// 阶段的结束时间属于下一个阶段
+		{elapsed: 10 * time.Second, stage: "2:step:100:200:50:5s", rate: 100, ok: true},
+		{elapsed: 15*time.Second - time.Millisecond, stage: "2:step:100:200:50:5s", rate: 100, ok: true},
+		{elapsed: 15 * time.Second, stage: "2:step:100:200:50:5s", rate: 150, ok: true},
+		{elapsed: 20 * time.Second, stage: "2:step:100:200:50:5s", rate: 200, ok: true},
+		{elapsed: 25 * time.Second, stage: "3:spike:1000:1s", rate: 1000, ok: true},
+		{elapsed: 26*time.Second - time.Nanosecond, stage: "3:spike:1000:1s", rate: 1000, ok: true},
+		// 超过总时长后曲线结束
+		{elapsed: 26 * time.Second, ok: false},
+		{elapsed: time.Hour, ok: false},
+	}
+	if total := profile.Duration(); total != 26*time.Second {
+		t.Fatalf("Duration = %s", total)
+	}
+	for _, tt := range tests {
+		stage, rate, ok := profile.At(tt.elapsed)
+		if ok != tt.ok || stage.Name != tt.stage || rate < tt.rate-1e-9 || rate > tt.rate+1e-9 {
+			t.Errorf("At(%s) = %s, %g, %v，期望 %s, %g, %v", tt.elapsed, stage.Name, rate, ok, tt.stage, tt.rate, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package sender
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// 收件人分配方式
+const (
+	// RcptRoundRobin 按顺序轮流分配收件人
+	RcptRoundRobin = "roundrobin"
+	// RcptRandom 随机分配收件人
+	RcptRandom = "random"
+)
+
+// recipientPicker 从收件人列表中为每封邮件分配收件人
+type recipientPicker struct {
+	mu         sync.Mutex
+	recipients []string
+	perMessage int
+	random     bool
+	index      int
+	rand       *rand.Rand
+}
+
+func newRecipientPicker(recipients []string, perMessage int, mode string) *recipientPicker {
+	if perMessage < 1 {
+		perMessage = 1
+	}
+	if perMessage > len(recipients) {
+		perMessage = len(recipients)
+	}
+	return &recipientPicker{
+		recipients: recipients,
+		perMessage: perMessage,
+		random:     mode == RcptRandom,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// pick 返回一封邮件的收件人，同一封邮件中的收件人不重复
+func (p *recipientPicker) pick() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	to := make([]string, 0, p.perMessage)
+	if p.random {
+		for _, i := range p.rand.Perm(len(p.recipients))[:p.perMessage] {
+			to = append(to, p.recipients[i])
+		}
+		return to
+	}
+	for i := 0; i < p.perMessage; i++ {
+		to = append(to, p.recipients[p.index])
+		p.index = (p.index + 1) % len(p.recipients)
+	}
+	return to
+}
@@ -0,0 +1,74 @@
+package sender
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// 不对应具体命令的响应使用的命令名
+const (
+	// CommandConnect 建立连接后服务器的欢迎信息
+	CommandConnect = "CONNECT"
+	// CommandDataEnd DATA发送邮件内容结束后的最终响应
+	CommandDataEnd = "."
+)
+
+// Reply 服务器的一个响应
+type Reply struct {
+	// Command 该响应对应的命令名，如 MAIL、RCPT，AUTH的后续数据也记为 AUTH
+	Command string `json:"command,omitempty"`
+	Code    int    `json:"code"`
+	// Enhanced 增强状态码，如 2.0.0，服务器没有返回时为空
+	Enhanced string `json:"enhanced,omitempty"`
+	// Text 响应文本，多行响应以换行符连接，不包含响应码
+	Text string `json:"text"`
+	// QueueID 从响应中解析出的服务器队列ID
+	QueueID string `json:"queueID,omitempty"`
+}
+
+// String 按 "命令 响应码 响应文本" 的格式返回响应，多行响应以空格连接
+func (r Reply) String() string {
+	text := strings.ReplaceAll(r.Text, "\n", " ")
+	if r.Command == "" {
+		return fmt.Sprintf("%d %s", r.Code, text)
+	}
+	return fmt.Sprintf("%s %d %s", r.Command, r.Code, text)
+}
+
+var (
+	enhancedPattern = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+	// queueIDPatterns 常见MTA在接受邮件时返回的队列ID格式：
+	// Postfix "queued as 4Q2...", Exim "OK id=1abc-...", Sendmail "3AB12CD Message accepted for delivery"
+	queueIDPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)queued as\s+<?([A-Za-z0-9._@-]+)`),
+		regexp.MustCompile(`(?i)\bid=([A-Za-z0-9._-]+)`),
+		regexp.MustCompile(`(?i)^(?:[245]\.\d{1,3}\.\d{1,3}\s+)?([A-Za-z0-9]+)\s+Message accepted`),
+	}
+)
+
+func newReply(code int, text string) Reply {
+	r := Reply{Code: code, Text: text}
+	first, _, _ := strings.Cut(text, "\n")
+	r.Enhanced = enhancedPattern.FindString(first)
+	for _, line := range strings.Split(text, "\n") {
+		for _, pattern := range queueIDPatterns {
+			if m := pattern.FindStringSubmatch(line); m != nil {
+				r.QueueID = strings.TrimRight(m[1], ".")
+				return r
+			}
+		}
+	}
+	return r
+}
+
+// errorReply 返回错误中服务器的响应，不是服务器返回的错误时返回 false
+func errorReply(err error) (Reply, bool) {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return newReply(smtpErr.Code, smtpErr.Msg), true
+	}
+	return Reply{}, false
+}
@@ -0,0 +1,319 @@
+package sender
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record 报告中一封邮件的记录
+type Record struct {
+	Type     string    `json:"type"`
+	Path     string    `json:"path"`
+	Account  string    `json:"account,omitempty"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	ClientIP string    `json:"clientIP,omitempty"`
+	Size     int       `json:"size"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	// DurationMs SMTP发送的耗时，FetchMs 为下载邮件内容的耗时，单位均为毫秒
+	DurationMs float64 `json:"durationMs"`
+	FetchMs    float64 `json:"fetchMs,omitempty"`
+	// PhasesMs 各阶段的耗时，只包含经过的阶段
+	PhasesMs     map[string]float64 `json:"phasesMs"`
+	NewConn      bool               `json:"newConn"`
+	Reused       bool               `json:"reused"`
+	TLSVersion   string             `json:"tlsVersion,omitempty"`
+	TLSCipher    string             `json:"tlsCipher,omitempty"`
+	Pipelined    bool               `json:"pipelined"`
+	Chunked      bool               `json:"chunked"`
+	LoadStage    string             `json:"loadStage,omitempty"`
+	LateMs       float64            `json:"lateMs,omitempty"`
+	RcptAccepted int                `json:"rcptAccepted"`
+	RcptRejected int                `json:"rcptRejected"`
+	// Code、Enhanced 和 Response 为最终响应，QueueID 为从中解析出的队列ID
+	Code     int    `json:"code"`
+	Enhanced string `json:"enhanced,omitempty"`
+	Response string `json:"response,omitempty"`
+	QueueID  string `json:"queueID,omitempty"`
+	// Replies 发送期间服务器的所有响应
+	Replies []Reply `json:"replies,omitempty"`
+	// Stage 失败时所处的阶段，Class 为结果分类
+	Stage Stage  `json:"stage,omitempty"`
+	Class string `json:"class"`
+	Error string `json:"error,omitempty"`
+}
+
+// NewRecord 将发送结果转换为报告记录
+func NewRecord(r *Result) Record {
+	rec := Record{
+		Type:       "message",
+		Path:       r.Path,
+		Account:    r.Account,
+		From:       r.From,
+		To:         r.To,
+		ClientIP:   r.ClientIP,
+		Size:       r.Size,
+		Start:      r.Start,
+		End:        r.Start.Add(r.Duration),
+		DurationMs: milliseconds(r.Duration),
+		FetchMs:    milliseconds(r.FetchTime),
+		PhasesMs:   map[string]float64{},
+		NewConn:    r.NewConn,
+		Reused:     r.Reused,
+		TLSVersion: r.TLSVersion,
+		TLSCipher:  r.TLSCipher,
+		Pipelined:  r.Pipelined,
+		Chunked:    r.Chunked,
+		LoadStage:  r.LoadStage,
+		LateMs:     milliseconds(r.Late),
+		Code:       r.Reply.Code,
+		Enhanced:   r.Reply.Enhanced,
+		Response:   r.Reply.Text,
+		QueueID:    r.Reply.QueueID,
+		Replies:    r.Replies,
+		Stage:      r.Stage,
+		Class:      r.ErrorClass(),
+	}
+	for _, phase := range r.Timings.Phases() {
+		if phase.Duration > 0 {
+			rec.PhasesMs[phase.Name] = milliseconds(phase.Duration)
+		}
+	}
+	for _, rcpt := range r.Rcpts {
+		if rcpt.Accepted() {
+			rec.RcptAccepted++
+		} else {
+			rec.RcptRejected++
+		}
+	}
+	if r.Err != nil {
+		rec.Error = r.Err.Error()
+	}
+	return rec
+}
+
+// csvHeader CSV报告的列，各阶段的耗时按 Timings.Phases 的顺序排列在 durationMs 之后
+func csvHeader() []string {
+	header := []string{"path", "account", "from", "to", "clientIP", "size", "start", "end", "durationMs", "fetchMs"}
+	for _, phase := range (Timings{}).Phases() {
+		header = append(header, phase.Name+"Ms")
+	}
+	return append(header, "newConn", "reused", "tlsVersion", "tlsCipher", "pipelined", "chunked", "loadStage", "lateMs",
+		"rcptAccepted", "rcptRejected", "code", "enhanced", "response", "queueID", "replies", "stage", "class", "error")
+}
+
+func formatMs(ms float64) string {
+	return strconv.FormatFloat(ms, 'f', 3, 64)
+}
+
+func (rec Record) csvRow() []string {
+	row := []string{rec.Path, rec.Account, rec.From, strings.Join(rec.To, ";"), rec.ClientIP, strconv.Itoa(rec.Size),
+		rec.Start.Format(time.RFC3339Nano), rec.End.Format(time.RFC3339Nano), formatMs(rec.DurationMs), formatMs(rec.FetchMs)}
+	for _, phase := range (Timings{}).Phases() {
+		row = append(row, formatMs(rec.PhasesMs[phase.Name]))
+	}
+	return append(row, strconv.FormatBool(rec.NewConn), strconv.FormatBool(rec.Reused), rec.TLSVersion, rec.TLSCipher,
+		strconv.FormatBool(rec.Pipelined), strconv.FormatBool(rec.Chunked), rec.LoadStage, formatMs(rec.LateMs),
+		strconv.Itoa(rec.RcptAccepted), strconv.Itoa(rec.RcptRejected), strconv.Itoa(rec.Code), rec.Enhanced, rec.Response,
+		rec.QueueID, formatReplies(rec.Replies), string(rec.Stage), rec.Class, rec.Error)
+}
+
+// formatReplies 将所有响应格式化为一列，每个响应一行
+func formatReplies(replies []Reply) string {
+	lines := make([]string, len(replies))
+	for i, reply := range replies {
+		lines[i] = reply.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ReportWriter 将每封邮件的结果和运行汇总写入报告文件，
+// 文件名以 .csv 结尾时使用CSV格式，汇总写入同名的 .summary.json 文件，否则使用JSON Lines格式，汇总为最后一行
+type ReportWriter struct {
+	path    string
+	file    *os.File
+	csv     *csv.Writer
+	encoder *json.Encoder
+}
+
+func NewReportWriter(path string) (*ReportWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &ReportWriter{path: path, file: file}
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		w.csv = csv.NewWriter(file)
+		if err := w.csv.Write(csvHeader()); err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else {
+		w.encoder = json.NewEncoder(file)
+	}
+	return w, nil
+}
+
+// Write 写入一封邮件的结果
+func (w *ReportWriter) Write(r *Result) error {
+	rec := NewRecord(r)
+	if w.csv != nil {
+		return w.csv.Write(rec.csvRow())
+	}
+	return w.encoder.Encode(rec)
+}
+
+// Close 写入运行汇总并关闭文件
+func (w *ReportWriter) Close(summary RunSummary) error {
+	var err error
+	if w.csv != nil {
+		w.csv.Flush()
+		err = w.csv.Error()
+		if err == nil {
+			var data []byte
+			if data, err = json.MarshalIndent(summary, "", "  "); err == nil {
+				name := strings.TrimSuffix(w.path, w.path[len(w.path)-4:]) + ".summary.json"
+				err = os.WriteFile(name, data, 0644)
+			}
+		}
+	} else {
+		err = w.encoder.Encode(summary)
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadRecords 读取 ReportWriter 写入的报告文件中每封邮件的记录，按文件名判断格式，忽略汇总记录
+func ReadRecords(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		return readCSVRecords(file)
+	}
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		data := scanner.Bytes()
+		if len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("第%d行格式错误：%w", line, err)
+		}
+		if rec.Type == "message" {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// readCSVRecords 按表头读取CSV报告，replies 列只用于查看，不会还原
+func readCSVRecords(r io.Reader) ([]Record, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[name] = i
+	}
+	var records []Record
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rec, err := recordFromCSV(columns, row)
+		if err != nil {
+			return nil, fmt.Errorf("第%d行格式错误：%w", line, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func recordFromCSV(columns map[string]int, row []string) (Record, error) {
+	get := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+	// 数值列为空时为0，其余格式错误时返回第一个错误
+	var err error
+	number := func(name string) float64 {
+		v := get(name)
+		if v == "" {
+			return 0
+		}
+		f, e := strconv.ParseFloat(v, 64)
+		if e != nil && err == nil {
+			err = fmt.Errorf("%s：%w", name, e)
+		}
+		return f
+	}
+	timestamp := func(name string) time.Time {
+		t, e := time.Parse(time.RFC3339Nano, get(name))
+		if e != nil && err == nil {
+			err = fmt.Errorf("%s：%w", name, e)
+		}
+		return t
+	}
+	rec := Record{
+		Type:         "message",
+		Path:         get("path"),
+		Account:      get("account"),
+		From:         get("from"),
+		ClientIP:     get("clientIP"),
+		Size:         int(number("size")),
+		Start:        timestamp("start"),
+		End:          timestamp("end"),
+		DurationMs:   number("durationMs"),
+		FetchMs:      number("fetchMs"),
+		PhasesMs:     map[string]float64{},
+		NewConn:      get("newConn") == "true",
+		Reused:       get("reused") == "true",
+		TLSVersion:   get("tlsVersion"),
+		TLSCipher:    get("tlsCipher"),
+		Pipelined:    get("pipelined") == "true",
+		Chunked:      get("chunked") == "true",
+		LoadStage:    get("loadStage"),
+		LateMs:       number("lateMs"),
+		RcptAccepted: int(number("rcptAccepted")),
+		RcptRejected: int(number("rcptRejected")),
+		Code:         int(number("code")),
+		Enhanced:     get("enhanced"),
+		Response:     get("response"),
+		QueueID:      get("queueID"),
+		Stage:        Stage(get("stage")),
+		Class:        get("class"),
+		Error:        get("error"),
+	}
+	if to := get("to"); to != "" {
+		rec.To = strings.Split(to, ";")
+	}
+	for _, phase := range (Timings{}).Phases() {
+		if ms := number(phase.Name + "Ms"); ms > 0 {
+			rec.PhasesMs[phase.Name] = ms
+		}
+	}
+	return rec, err
+}
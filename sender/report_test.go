@@ -0,0 +1,78 @@
+package sender
+
+import (
+	"errors"
+	"net/textproto"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testResults 覆盖成功、部分收件人被拒绝和连接失败的结果
+func testResults() []*Result {
+	start := time.Date(2024, 1, 1, 9, 0, 0, 123456000, time.UTC)
+	ok := newReply(250, "2.0.0 Ok: queued as 4F1A2B3C")
+	rejected := newReply(550, "5.7.1 Message rejected, \"spam\"")
+	return []*Result{
+		{
+			Path: "/eml/a/1.eml", Size: 1234, From: "from@example.com", To: []string{"a@example.com", "b@example.com"},
+			ClientIP: "192.0.2.1", Start: start, Duration: 12345 * time.Microsecond, FetchTime: 2500 * time.Microsecond,
+			Timings: Timings{Connect: time.Millisecond, Banner: 2 * time.Millisecond, EHLO: 500 * time.Microsecond, Data: 3 * time.Millisecond},
+			NewConn: true, TLSVersion: "TLS 1.3", TLSCipher: "TLS_AES_128_GCM_SHA256", Pipelined: true, Account: "from@example.com",
+			Reply:   ok,
+			Replies: []Reply{{Command: CommandConnect, Code: 220, Text: "mx ESMTP"}, ok},
+			Rcpts:   []RcptResult{{Addr: "a@example.com", Code: 250}, {Addr: "b@example.com", Code: 550, Msg: "no such user"}},
+		},
+		{
+			Path: "/eml/a/2.eml", Size: 99, From: "from@example.com", To: []string{"a@example.com"},
+			Start: start.Add(time.Second), Duration: 7 * time.Millisecond, Reused: true, Chunked: true, LoadStage: "ramp", Late: 15 * time.Millisecond,
+			Timings: Timings{Reset: time.Millisecond, Mail: time.Millisecond},
+			Reply:   rejected, Replies: []Reply{rejected},
+			Stage: StageData, Err: &textproto.Error{Code: 550, Msg: rejected.Text},
+		},
+		{
+			Path: "/eml/a/3.eml", Size: 10, From: "from@example.com", To: []string{"a@example.com"},
+			Start: start.Add(2 * time.Second), Duration: time.Second, NewConn: true,
+			Stage: StageConnect, Err: errors.New("dial tcp 127.0.0.1:25: connect: connection refused"),
+		},
+	}
+}
+
+func TestReadRecords(t *testing.T) {
+	results := testResults()
+	for _, name := range []string{"report.jsonl", "report.csv"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			w, err := NewReportWriter(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, res := range results {
+				if err := w.Write(res); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(NewSummary().Report()); err != nil {
+				t.Fatal(err)
+			}
+			records, err := ReadRecords(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != len(results) {
+				t.Fatalf("读取到 %d 条记录，期望 %d 条", len(records), len(results))
+			}
+			for i, res := range results {
+				want := NewRecord(res)
+				if filepath.Ext(name) == ".csv" {
+					// CSV中的 replies 列只用于查看，不会还原
+					want.Replies = nil
+				}
+				if !reflect.DeepEqual(records[i], want) {
+					t.Errorf("第%d条记录为\n%+v\n期望\n%+v", i+1, records[i], want)
+				}
+			}
+		})
+	}
+}
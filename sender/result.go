@@ -0,0 +1,185 @@
+package sender
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"time"
+)
+
+// Stage 发送邮件的阶段，用于标记失败发生的位置
+type Stage string
+
+const (
+	StageSource  Stage = "source"
+	StageDNS     Stage = "dns"
+	StageConnect Stage = "connect"
+	StageGreet   Stage = "greeting"
+	StageTLS     Stage = "tls"
+	StageAuth    Stage = "auth"
+	StageXClient Stage = "xclient"
+	StageMail    Stage = "mail"
+	StageRcpt    Stage = "rcpt"
+	StageData    Stage = "data"
+	// StageDropped 开放模型中进行中的邮件数达到上限，邮件没有发送
+	StageDropped Stage = "dropped"
+)
+
+// Result 单封邮件的发送结果
+type Result struct {
+	Path string
+	Size int
+	From string
+	To   []string
+	// ClientIP 通过XCLIENT设置的原始客户端IP
+	ClientIP string
+	Start    time.Time
+	Duration time.Duration
+	// Late 开放模型中实际派发时间晚于计划时间的时长
+	Late time.Duration
+	// LoadStage 按负载曲线发送时派发该邮件所处的阶段
+	LoadStage string
+	// FetchTime 从对象存储下载邮件内容的耗时，不包含在 Duration 中
+	FetchTime time.Duration
+	// Timings 各阶段的耗时
+	Timings Timings
+	// NewConn 为 true 表示为该邮件新建了连接，ConnectTime 为建立连接、TLS握手、XCLIENT和认证的耗时
+	NewConn     bool
+	ConnectTime time.Duration
+	// Reused 为 true 表示复用了之前的连接
+	Reused bool
+	// TLSVersion 和 TLSCipher 为协商的TLS版本和加密套件，未使用TLS时为空
+	TLSVersion string
+	TLSCipher  string
+	// Pipelined 和 Chunked 表示发送时是否使用了PIPELINING和BDAT
+	Pipelined bool
+	Chunked   bool
+	// Account 发件账户，登录模式下为认证使用的账户
+	Account string
+	// Reply 成功时为邮件内容的最终响应，失败时为服务器返回的错误响应
+	Reply Reply
+	// Replies 发送这封邮件期间服务器的所有响应，按顺序排列，新建连接时包括欢迎信息、EHLO和认证的响应
+	Replies []Reply
+	// Rcpts 每个收件人的RCPT响应，部分收件人被拒绝时邮件仍会发送
+	Rcpts []RcptResult
+	// Stage 失败时所处的阶段，成功时为空
+	Stage Stage
+	Err   error
+}
+
+// OK 邮件是否发送成功
+func (r *Result) OK() bool {
+	return r.Err == nil
+}
+
+// Code 失败时服务器返回的SMTP响应码，成功或不是服务器返回的错误时为0
+func (r *Result) Code() int {
+	var err *textproto.Error
+	if errors.As(r.Err, &err) {
+		return err.Code
+	}
+	return 0
+}
+
+// 结果分类
+const (
+	ClassOK         = "ok"
+	ClassDeferred   = "deferred"
+	ClassRejected   = "rejected"
+	ClassDNS        = "dns"
+	ClassConnect    = "connect"
+	ClassTLS        = "tls"
+	ClassTimeout    = "timeout"
+	ClassConnection = "connection"
+	ClassSource     = "source"
+	ClassDropped    = "dropped"
+)
+
+// ErrorClass 返回结果分类：成功、4xx延迟、5xx拒绝，或者没有收到服务器响应的错误所在的环节
+func (r *Result) ErrorClass() string {
+	if r.OK() {
+		return ClassOK
+	}
+	switch r.Stage {
+	case StageSource:
+		return ClassSource
+	case StageDropped:
+		return ClassDropped
+	}
+	if code := r.Code(); code >= 500 {
+		return ClassRejected
+	} else if code >= 400 {
+		return ClassDeferred
+	}
+	var netErr net.Error
+	if errors.As(r.Err, &netErr) && netErr.Timeout() {
+		return ClassTimeout
+	}
+	switch r.Stage {
+	case StageDNS:
+		return ClassDNS
+	case StageConnect:
+		return ClassConnect
+	case StageTLS:
+		return ClassTLS
+	}
+	return ClassConnection
+}
+
+// Timings 一封邮件各阶段的耗时，没有经过的阶段为0，复用连接时连接相关的阶段为0
+type Timings struct {
+	DNS     time.Duration
+	Connect time.Duration
+	// TLS 隐式TLS的握手或STARTTLS命令及握手
+	TLS    time.Duration
+	Banner time.Duration
+	// EHLO 包括STARTTLS之后重新发送的EHLO
+	EHLO  time.Duration
+	Auth  time.Duration
+	Reset time.Duration
+	// XClient 包括XCLIENT之后重新发送的EHLO
+	XClient time.Duration
+	Mail    time.Duration
+	Rcpt    time.Duration
+	// Data DATA命令及邮件内容的传输，使用BDAT时为最后一个分块的响应之前的时间
+	Data time.Duration
+	// Final 邮件内容发送完毕到收到最终响应
+	Final time.Duration
+}
+
+// PhaseTiming 一个阶段的名称和耗时
+type PhaseTiming struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Phases 按发送顺序返回所有阶段的耗时
+func (t Timings) Phases() []PhaseTiming {
+	return []PhaseTiming{
+		{"dns", t.DNS},
+		{"connect", t.Connect},
+		{"tls", t.TLS},
+		{"banner", t.Banner},
+		{"ehlo", t.EHLO},
+		{"auth", t.Auth},
+		{"rset", t.Reset},
+		{"xclient", t.XClient},
+		{"mail", t.Mail},
+		{"rcpt", t.Rcpt},
+		{"data", t.Data},
+		{"final", t.Final},
+	}
+}
+
+// RcptResult 单个收件人的RCPT响应
+type RcptResult struct {
+	Addr string
+	// Code 为0表示没有收到响应
+	Code int
+	Msg  string
+}
+
+// Accepted 收件人是否被服务器接受
+func (r RcptResult) Accepted() bool {
+	return r.Code >= 250 && r.Code < 260
+}
@@ -0,0 +1,199 @@
+package sender
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dialTimeout = 30 * time.Second
+
+// session 一条SMTP连接
+type session struct {
+	client *client
+	// pipelining 和 chunking 为 true 表示配置开启且服务器支持该扩展
+	pipelining bool
+	chunking   bool
+	chunkSize  int
+	// username 和 password 为登录模式下认证使用的账户，authed 表示当前会话已经认证
+	username string
+	password string
+	authed   bool
+	// count 该连接上已经发送的邮件数
+	count int
+	// metrics 连接建立完成后设置，关闭时更新打开的连接数
+	metrics *Metrics
+}
+
+// dial 建立连接并完成握手，按TLS模式决定是否使用TLS，各阶段的耗时写入 t，服务器的响应记录到 replies
+func (e *Engine) dial(t *Timings, replies *[]Reply) (*session, Stage, error) {
+	mode := e.tlsMode()
+	conn, stage, err := e.dialTCP(t)
+	if err != nil {
+		return nil, stage, err
+	}
+	if mode == TLSImplicit {
+		start := time.Now()
+		tlsConn := tls.Client(conn, e.tlsConfig())
+		conn.SetDeadline(time.Now().Add(dialTimeout))
+		err := tlsConn.Handshake()
+		t.TLS = time.Since(start)
+		if err != nil {
+			conn.Close()
+			return nil, StageTLS, err
+		}
+		conn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	start := time.Now()
+	client, err := newClient(conn, e.cfg.Server, replies)
+	t.Banner = time.Since(start)
+	if err != nil {
+		conn.Close()
+		return nil, StageGreet, err
+	}
+	s := &session{client: client}
+	start = time.Now()
+	err = client.hello()
+	t.EHLO = time.Since(start)
+	if err != nil {
+		s.close()
+		return nil, StageGreet, err
+	}
+	if mode == TLSStartTLS || mode == TLSStartTLSRequired {
+		start = time.Now()
+		if ok, _ := client.extension("STARTTLS"); ok {
+			err = client.startTLS(e.tlsConfig())
+		} else if mode == TLSStartTLSRequired {
+			err = errors.New("服务器不支持STARTTLS")
+		}
+		t.TLS = time.Since(start)
+		if err != nil {
+			s.close()
+			return nil, StageTLS, err
+		}
+		if _, ok := client.tlsConnectionState(); ok {
+			start = time.Now()
+			err = client.hello()
+			t.EHLO += time.Since(start)
+			if err != nil {
+				s.close()
+				return nil, StageGreet, err
+			}
+		}
+	}
+	if ok, _ := client.extension("PIPELINING"); ok {
+		s.pipelining = e.cfg.Pipelining
+	}
+	if ok, _ := client.extension("CHUNKING"); ok {
+		s.chunking = e.cfg.Chunking
+	}
+	s.chunkSize = e.cfg.ChunkSize
+	s.metrics = e.cfg.Metrics
+	s.metrics.connOpened()
+	return s, "", nil
+}
+
+// dialTCP 解析服务器地址并依次尝试建立TCP连接
+func (e *Engine) dialTCP(t *Timings) (net.Conn, Stage, error) {
+	start := time.Now()
+	hosts := []string{e.cfg.Server}
+	if net.ParseIP(e.cfg.Server) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		var err error
+		hosts, err = net.DefaultResolver.LookupHost(ctx, e.cfg.Server)
+		cancel()
+		t.DNS = time.Since(start)
+		if err != nil {
+			return nil, StageDNS, err
+		}
+	}
+	start = time.Now()
+	defer func() { t.Connect = time.Since(start) }()
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var err error
+	for _, host := range hosts {
+		var conn net.Conn
+		if conn, err = dialer.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(e.cfg.Port))); err == nil {
+			return conn, "", nil
+		}
+	}
+	return nil, StageConnect, err
+}
+
+// tlsState 返回协商的TLS版本和加密套件，未使用TLS时返回空
+func (s *session) tlsState() (string, string) {
+	state, ok := s.client.tlsConnectionState()
+	if !ok {
+		return "", ""
+	}
+	return TLSVersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)
+}
+
+func (s *session) auth(username, password string) error {
+	return s.client.auth(&plainAuth{username: username, password: password})
+}
+
+// xclient 服务器支持XCLIENT时将客户端地址设置为 clientIP，返回是否发送了XCLIENT
+func (s *session) xclient(clientIP string) (bool, error) {
+	if ok, _ := s.client.extension("XCLIENT"); !ok {
+		return false, nil
+	}
+	return true, s.client.xclient("ADDR=" + xtext(xclientAddr(clientIP)))
+}
+
+// xclientAddr 返回XCLIENT的ADDR属性值，IPv6地址需要加上 IPV6: 前缀
+func xclientAddr(clientIP string) string {
+	if ip := net.ParseIP(clientIP); ip != nil && ip.To4() == nil {
+		return "IPV6:" + clientIP
+	}
+	return clientIP
+}
+
+// xtext 按RFC 3461的xtext编码XCLIENT的属性值，可见ASCII字符中除 + 和 = 外原样保留，其余编码为 +XX
+func xtext(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// send 发送一封邮件，返回每个收件人的RCPT响应和失败所在的阶段
+func (s *session) send(from string, to []string, content []byte, t *Timings) ([]RcptResult, Stage, error) {
+	rcpts, stage, err := s.client.envelope(from, to, !s.chunking, s.pipelining, t)
+	if err != nil {
+		return rcpts, stage, err
+	}
+	if s.chunking {
+		err = s.client.bdat(content, s.chunkSize, s.pipelining, t)
+	} else {
+		err = s.client.data(content, t)
+	}
+	if err != nil {
+		return rcpts, StageData, err
+	}
+	return rcpts, "", nil
+}
+
+// reset 发送RSET，复用连接发送下一封邮件前调用
+func (s *session) reset() error {
+	return s.client.reset()
+}
+
+// close 发送QUIT后关闭连接
+func (s *session) close() {
+	s.client.quit()
+	s.client.close()
+	s.metrics.connClosed()
+}
@@ -0,0 +1,484 @@
+package sender
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Summary 汇总一次运行中所有邮件的发送结果
+type Summary struct {
+	mu      sync.Mutex
+	start   time.Time
+	total   int
+	success int
+	failed  int
+	sum     time.Duration
+	max     time.Duration
+	// conns 新建的连接数，connectSum 为建立连接的总耗时
+	conns      int
+	connectSum time.Duration
+	// 新建连接和复用连接发送成功的邮件数及耗时
+	newConnCount int
+	newConnSum   time.Duration
+	reusedCount  int
+	reusedSum    time.Duration
+	// pipelined 和 chunked 为使用PIPELINING和BDAT发送成功的邮件数
+	pipelined int
+	chunked   int
+	// rcptAccepted 和 rcptRejected 为被接受和被拒绝的收件人数，partial 为部分收件人被拒绝的邮件数
+	rcptAccepted int
+	rcptRejected int
+	partial      int
+	// fetched 从对象存储下载的邮件数，fetchSum 和 fetchMax 为下载耗时
+	fetched  int
+	fetchSum time.Duration
+	fetchMax time.Duration
+	// dispatched 和 bytes 为派发给工作协程的邮件数和字节数，rate 和 byteRate 为目标速率
+	dispatched int
+	bytes      int64
+	rate       float64
+	byteRate   float64
+	// latency 成功邮件的耗时分布，perSecond 为每秒完成发送的成功邮件数，键为距开始的秒数
+	latency   *Histogram
+	perSecond map[int64]int
+	// interval 大于0时按该时长划分时间段分别统计，buckets 的键为时间段的序号
+	interval time.Duration
+	buckets  map[int64]*timeBucket
+	// classes 按结果分类统计的邮件数
+	classes map[string]int
+	// phaseSum 和 phaseCount 为各阶段的总耗时和经过该阶段的邮件数
+	phaseSum   map[string]time.Duration
+	phaseCount map[string]int
+	// openModel 为 true 时统计开放模型的迟到和放弃发送的邮件数
+	openModel bool
+	late      int
+	maxLate   time.Duration
+	dropped   int
+	// profile 负载曲线，stages 为每个阶段的发送结果
+	profile Profile
+	stages  map[string]*stageSummary
+	// tls 按 TLS版本/加密套件 统计的成功邮件数
+	tls map[string]int
+}
+
+// stageSummary 负载曲线中一个阶段的发送结果
+type stageSummary struct {
+	total   int
+	success int
+	// deferred 和 rejected 为服务器返回4xx和5xx的邮件数，failed 为其他原因失败的邮件数
+	deferred int
+	rejected int
+	failed   int
+	sum      time.Duration
+}
+
+func NewSummary() *Summary {
+	return &Summary{start: time.Now(), tls: map[string]int{}, stages: map[string]*stageSummary{}, phaseSum: map[string]time.Duration{}, phaseCount: map[string]int{},
+		classes: map[string]int{}, latency: NewHistogram(), perSecond: map[int64]int{}, buckets: map[int64]*timeBucket{}}
+}
+
+// timeBucket 一个时间段内的发送结果
+type timeBucket struct {
+	total   int
+	success int
+	latency *Histogram
+}
+
+// BucketStats 一个时间段的统计结果
+type BucketStats struct {
+	Start   time.Time
+	Total   int
+	Success int
+	Failed  int
+	// Throughput 该时间段内每秒发送成功的邮件数
+	Throughput float64
+	Latency    HistogramSnapshot
+}
+
+// SetInterval 设置统计时间段的长度，大于0时按时间段输出耗时分布和吞吐量
+func (s *Summary) SetInterval(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interval = interval
+}
+
+// SetProfile 设置负载曲线，输出汇总时按阶段输出发送结果
+func (s *Summary) SetProfile(profile Profile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.profile = profile
+}
+
+// SetTarget 设置目标速率，输出汇总时与实际速率进行对比
+func (s *Summary) SetTarget(rate, byteRate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rate, s.byteRate = rate, byteRate
+}
+
+// SetOpenModel 按开放模型发送时调用，输出汇总时输出迟到和放弃发送的邮件数
+func (s *Summary) SetOpenModel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.openModel = true
+}
+
+// Add 记录一封邮件的结果，可并发调用
+func (s *Summary) Add(r *Result) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total++
+	s.classes[r.ErrorClass()]++
+	if r.LoadStage != "" {
+		s.addStage(r)
+	}
+	for _, phase := range r.Timings.Phases() {
+		if phase.Duration > 0 {
+			s.phaseSum[phase.Name] += phase.Duration
+			s.phaseCount[phase.Name]++
+		}
+	}
+	if r.Stage != StageDropped && r.Stage != StageSource {
+		s.addBucket(r)
+	}
+	if r.Late > lateThreshold {
+		s.late++
+	}
+	if r.Late > s.maxLate {
+		s.maxLate = r.Late
+	}
+	if r.Stage == StageDropped {
+		s.dropped++
+	}
+	if r.Stage != StageSource && r.Stage != StageDropped {
+		s.dispatched++
+		s.bytes += int64(r.Size)
+	}
+	rejected := 0
+	for _, rcpt := range r.Rcpts {
+		if rcpt.Accepted() {
+			s.rcptAccepted++
+		} else {
+			rejected++
+		}
+	}
+	s.rcptRejected += rejected
+	if r.OK() && rejected > 0 {
+		s.partial++
+	}
+	if r.FetchTime > 0 {
+		s.fetched++
+		s.fetchSum += r.FetchTime
+		if r.FetchTime > s.fetchMax {
+			s.fetchMax = r.FetchTime
+		}
+	}
+	if r.NewConn {
+		s.conns++
+		s.connectSum += r.ConnectTime
+	}
+	if !r.OK() {
+		s.failed++
+		return
+	}
+	s.success++
+	if r.Pipelined {
+		s.pipelined++
+	}
+	if r.Chunked {
+		s.chunked++
+	}
+	if r.Reused {
+		s.reusedCount++
+		s.reusedSum += r.Duration
+	} else {
+		s.newConnCount++
+		s.newConnSum += r.Duration
+	}
+	if r.TLSVersion != "" {
+		s.tls[r.TLSVersion+"/"+r.TLSCipher]++
+	} else {
+		s.tls["plaintext"]++
+	}
+	s.latency.Record(r.Duration)
+	s.perSecond[int64(r.Start.Add(r.Duration).Sub(s.start)/time.Second)]++
+	s.sum += r.Duration
+	if r.Duration > s.max {
+		s.max = r.Duration
+	}
+}
+
+// addBucket 按邮件完成的时间记录到所在的时间段，调用前需要持有锁
+func (s *Summary) addBucket(r *Result) {
+	if s.interval <= 0 {
+		return
+	}
+	key := int64(r.Start.Add(r.Duration).Sub(s.start) / s.interval)
+	bucket := s.buckets[key]
+	if bucket == nil {
+		bucket = &timeBucket{latency: NewHistogram()}
+		s.buckets[key] = bucket
+	}
+	bucket.total++
+	if r.OK() {
+		bucket.success++
+		bucket.latency.Record(r.Duration)
+	}
+}
+
+// Latency 返回成功邮件的耗时分布
+func (s *Summary) Latency() HistogramSnapshot {
+	return s.latency.Snapshot()
+}
+
+// Buckets 按时间顺序返回每个时间段的统计结果，没有设置时间段时返回 nil
+func (s *Summary) Buckets() []BucketStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bucketStats()
+}
+
+// bucketStats 调用前需要持有锁
+func (s *Summary) bucketStats() []BucketStats {
+	keys := make([]int64, 0, len(s.buckets))
+	for key := range s.buckets {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	stats := make([]BucketStats, 0, len(keys))
+	for _, key := range keys {
+		bucket := s.buckets[key]
+		stats = append(stats, BucketStats{
+			Start:      s.start.Add(time.Duration(key) * s.interval),
+			Total:      bucket.total,
+			Success:    bucket.success,
+			Failed:     bucket.total - bucket.success,
+			Throughput: float64(bucket.success) / s.interval.Seconds(),
+			Latency:    bucket.latency.Snapshot(),
+		})
+	}
+	return stats
+}
+
+// throughput 返回每秒成功发送邮件数的最小值、平均值和最大值，没有发送成功的邮件时返回 false，调用前需要持有锁
+func (s *Summary) throughput() (int, float64, int, bool) {
+	if len(s.perSecond) == 0 {
+		return 0, 0, 0, false
+	}
+	var last int64
+	for second := range s.perSecond {
+		if second > last {
+			last = second
+		}
+	}
+	// 最后一秒通常不完整，只有一秒时仍然统计
+	seconds := last
+	if seconds == 0 {
+		seconds = 1
+	}
+	min, max, total := -1, 0, 0
+	for second := int64(0); second < seconds; second++ {
+		n := s.perSecond[second]
+		total += n
+		if min < 0 || n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+	}
+	return min, float64(total) / float64(seconds), max, true
+}
+
+// addStage 记录负载曲线阶段的结果，调用前需要持有锁
+func (s *Summary) addStage(r *Result) {
+	stage := s.stages[r.LoadStage]
+	if stage == nil {
+		stage = &stageSummary{}
+		s.stages[r.LoadStage] = stage
+	}
+	stage.total++
+	switch code := r.Code(); {
+	case r.OK():
+		stage.success++
+		stage.sum += r.Duration
+	case code >= 400 && code < 500:
+		stage.deferred++
+	case code >= 500:
+		stage.rejected++
+	default:
+		stage.failed++
+	}
+}
+
+// logStages 按负载曲线的顺序输出每个阶段的结果，调用前需要持有锁
+func (s *Summary) logStages() {
+	for _, p := range s.profile {
+		stage := s.stages[p.Name]
+		if stage == nil {
+			continue
+		}
+		var avg time.Duration
+		if stage.success > 0 {
+			avg = stage.sum / time.Duration(stage.success)
+		}
+		target := strconv.FormatFloat(p.From, 'g', -1, 64)
+		if p.To != p.From {
+			target += "-" + strconv.FormatFloat(p.To, 'g', -1, 64)
+		}
+		log.Infof("负载阶段：%s,目标速率：%s 封/秒,实际派发速率：%.2f 封/秒,成功：%d 封,延迟(4xx)：%d 封,拒绝(5xx)：%d 封,其他失败：%d 封,平均耗时：%s",
+			p.Name, target, float64(stage.total)/p.Duration.Seconds(), stage.success, stage.deferred, stage.rejected, stage.failed, avg)
+	}
+}
+
+// RunSummary 一次运行的汇总结果，用于写入报告
+type RunSummary struct {
+	Type         string    `json:"type"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	DurationMs   float64   `json:"durationMs"`
+	Total        int       `json:"total"`
+	Success      int       `json:"success"`
+	Failed       int       `json:"failed"`
+	Dropped      int       `json:"dropped"`
+	Late         int       `json:"late"`
+	RcptAccepted int       `json:"rcptAccepted"`
+	RcptRejected int       `json:"rcptRejected"`
+	// Throughput 每秒发送成功的邮件数
+	Throughput float64 `json:"throughput"`
+	// Classes 按结果分类统计的邮件数
+	Classes map[string]int `json:"classes"`
+	// LatencyMs 成功邮件的耗时分布，单位为毫秒
+	LatencyMs map[string]float64 `json:"latencyMs"`
+	// PhasesMs 各阶段的平均耗时，单位为毫秒
+	PhasesMs map[string]float64 `json:"phasesMs"`
+}
+
+// perSecond 返回 d 时间内 n 封邮件的每秒邮件数，d 为0时返回0
+func perSecond(n int, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) / d.Seconds()
+}
+
+// milliseconds 将时长转换为毫秒
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Report 返回当前的汇总结果
+func (s *Summary) Report() RunSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	end := time.Now()
+	r := RunSummary{
+		Type:         "summary",
+		Start:        s.start,
+		End:          end,
+		DurationMs:   milliseconds(end.Sub(s.start)),
+		Total:        s.total,
+		Success:      s.success,
+		Failed:       s.failed,
+		Dropped:      s.dropped,
+		Late:         s.late,
+		RcptAccepted: s.rcptAccepted,
+		RcptRejected: s.rcptRejected,
+		Classes:      map[string]int{},
+		PhasesMs:     map[string]float64{},
+	}
+	if elapsed := end.Sub(s.start); elapsed > 0 {
+		r.Throughput = float64(s.success) / elapsed.Seconds()
+	}
+	for class, n := range s.classes {
+		r.Classes[class] = n
+	}
+	for name, n := range s.phaseCount {
+		r.PhasesMs[name] = milliseconds(s.phaseSum[name] / time.Duration(n))
+	}
+	l := s.latency.Snapshot()
+	r.LatencyMs = map[string]float64{
+		"min": milliseconds(l.Min), "mean": milliseconds(l.Mean), "stddev": milliseconds(l.StdDev),
+		"p50": milliseconds(l.P50), "p90": milliseconds(l.P90), "p95": milliseconds(l.P95),
+		"p99": milliseconds(l.P99), "p99.9": milliseconds(l.P999), "max": milliseconds(l.Max),
+	}
+	return r
+}
+
+// Log 输出汇总信息
+func (s *Summary) Log() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.start)
+	if s.success > 0 {
+		log.Info("平均发送邮件耗时：", s.sum/time.Duration(s.success))
+		log.Info("最大发送邮件耗时：", s.max)
+		l := s.latency.Snapshot()
+		log.Infof("发送邮件耗时分布：最小 %s,p50 %s,p90 %s,p95 %s,p99 %s,p99.9 %s,最大 %s,标准差 %s",
+			l.Min, l.P50, l.P90, l.P95, l.P99, l.P999, l.Max, l.StdDev)
+	}
+	if min, avg, max, ok := s.throughput(); ok {
+		log.Infof("每秒发送成功：最小 %d 封,平均 %.2f 封,最大 %d 封", min, avg, max)
+	}
+	for _, b := range s.bucketStats() {
+		log.Infof("时间段：%s,发送：%d 封,成功：%d 封,失败：%d 封,速率：%.2f 封/秒,p50 %s,p99 %s,最大 %s",
+			b.Start.Format("15:04:05"), b.Total, b.Success, b.Failed, b.Throughput, b.Latency.P50, b.Latency.P99, b.Latency.Max)
+	}
+	if s.fetched > 0 {
+		log.Infof("下载邮件：%d 封,平均下载耗时：%s,最大下载耗时：%s", s.fetched, s.fetchSum/time.Duration(s.fetched), s.fetchMax)
+	}
+	var phases []string
+	for _, phase := range (Timings{}).Phases() {
+		if n := s.phaseCount[phase.Name]; n > 0 {
+			phases = append(phases, fmt.Sprintf("%s %s(%d)", phase.Name, s.phaseSum[phase.Name]/time.Duration(n), n))
+		}
+	}
+	if len(phases) > 0 {
+		log.Info("各阶段平均耗时(邮件数)：", strings.Join(phases, ","))
+	}
+	if s.conns > 0 {
+		log.Infof("新建连接数：%d,平均建立连接耗时：%s,每条连接平均发送：%.2f 封", s.conns, s.connectSum/time.Duration(s.conns), float64(s.success)/float64(s.conns))
+	}
+	// 吞吐量为该类邮件数除以运行时长，单线程吞吐量为该类邮件数除以发送这些邮件的总耗时，即一个线程连续发送该类邮件时的速率
+	if s.newConnCount > 0 {
+		log.Infof("新建连接发送邮件：%d 封,平均耗时：%s,吞吐量：%.2f 封/秒,单线程吞吐量：%.2f 封/秒", s.newConnCount,
+			s.newConnSum/time.Duration(s.newConnCount), perSecond(s.newConnCount, elapsed), perSecond(s.newConnCount, s.newConnSum))
+	}
+	if s.reusedCount > 0 {
+		log.Infof("复用连接发送邮件：%d 封,平均耗时：%s,吞吐量：%.2f 封/秒,单线程吞吐量：%.2f 封/秒", s.reusedCount,
+			s.reusedSum/time.Duration(s.reusedCount), perSecond(s.reusedCount, elapsed), perSecond(s.reusedCount, s.reusedSum))
+	}
+	if s.rcptRejected > 0 {
+		log.Infof("收件人被接受：%d 个,被拒绝：%d 个,部分收件人被拒绝的邮件：%d 封", s.rcptAccepted, s.rcptRejected, s.partial)
+	}
+	if s.pipelined > 0 || s.chunked > 0 {
+		log.Infof("使用PIPELINING发送：%d 封,使用BDAT发送：%d 封", s.pipelined, s.chunked)
+	}
+	if elapsed > 0 {
+		log.Infof("发送速率：%.2f 封/秒", float64(s.success)/elapsed.Seconds())
+		if s.rate > 0 {
+			actual := float64(s.dispatched) / elapsed.Seconds()
+			log.Infof("目标派发速率：%.2f 封/秒,实际派发速率：%.2f 封/秒,达成：%.1f%%", s.rate, actual, actual/s.rate*100)
+		}
+		if s.byteRate > 0 {
+			actual := float64(s.bytes) / elapsed.Seconds()
+			log.Infof("目标字节速率：%.0f 字节/秒,实际字节速率：%.0f 字节/秒,达成：%.1f%%", s.byteRate, actual, actual/s.byteRate*100)
+		}
+	}
+	if s.openModel {
+		log.Infof("开放模型：迟到(超过%s)：%d 封,最大迟到：%s,达到并发上限放弃发送：%d 封", lateThreshold, s.late, s.maxLate, s.dropped)
+	}
+	s.logStages()
+	for k, v := range s.tls {
+		log.Infof("TLS协商结果：%s,%d 封", k, v)
+	}
+	log.Info("开始发送邮件时间：", s.start.Format("2006-01-02 15:04:05"))
+	log.Info("发送邮件总耗时：", elapsed)
+	log.Infof("发送邮件总数量：%d 封,成功：%d 封,失败：%d 封", s.total, s.success, s.failed)
+}
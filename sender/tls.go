@@ -0,0 +1,140 @@
+package sender
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLS模式
+const (
+	// TLSAuto 25端口使用明文，其余端口使用TLS
+	TLSAuto = "auto"
+	// TLSNone 不使用TLS
+	TLSNone = "none"
+	// TLSStartTLS 服务器支持STARTTLS时升级为TLS，否则使用明文
+	TLSStartTLS = "starttls"
+	// TLSStartTLSRequired 服务器不支持STARTTLS时发送失败
+	TLSStartTLSRequired = "starttls-required"
+	// TLSImplicit 建立连接后直接进行TLS握手
+	TLSImplicit = "implicit"
+)
+
+// ValidTLSMode 判断TLS模式是否合法
+func ValidTLSMode(mode string) bool {
+	switch mode {
+	case TLSAuto, TLSNone, TLSStartTLS, TLSStartTLSRequired, TLSImplicit:
+		return true
+	}
+	return false
+}
+
+// tlsMode 返回实际使用的TLS模式
+func (e *Engine) tlsMode() string {
+	if e.cfg.TLSMode == "" || e.cfg.TLSMode == TLSAuto {
+		if e.cfg.Port == 25 {
+			return TLSNone
+		}
+		return TLSImplicit
+	}
+	return e.cfg.TLSMode
+}
+
+func (e *Engine) tlsConfig() *tls.Config {
+	if e.cfg.TLSConfig != nil {
+		return e.cfg.TLSConfig.Clone()
+	}
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         e.cfg.Server,
+	}
+}
+
+// TLSOptions TLS证书校验与客户端证书配置
+type TLSOptions struct {
+	// Verify 为 true 时校验服务器证书，否则跳过校验
+	Verify bool
+	// CAFile PEM格式的CA证书文件，为空时使用系统证书，设置后总是校验服务器证书
+	CAFile string
+	// ServerName SNI及证书校验使用的主机名，为空时使用服务器地址
+	ServerName string
+	// MinVersion 和 MaxVersion 为 1.0,1.1,1.2,1.3，为空时使用Go的默认值
+	MinVersion string
+	MaxVersion string
+	// CertFile 和 KeyFile 为客户端证书和私钥，用于双向TLS认证
+	CertFile string
+	KeyFile  string
+}
+
+// NewTLSConfig 根据 TLSOptions 创建 tls.Config，server 为SMTP服务器地址
+func NewTLSConfig(opts TLSOptions, server string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: !opts.Verify && opts.CAFile == "",
+		ServerName:         server,
+	}
+	if opts.ServerName != "" {
+		cfg.ServerName = opts.ServerName
+	}
+	if opts.CAFile != "" {
+		pem, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA证书文件中没有有效的证书：%s", opts.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	var err error
+	if cfg.MinVersion, err = ParseTLSVersion(opts.MinVersion); err != nil {
+		return nil, err
+	}
+	if cfg.MaxVersion, err = ParseTLSVersion(opts.MaxVersion); err != nil {
+		return nil, err
+	}
+	if cfg.MinVersion != 0 && cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+		return nil, fmt.Errorf("TLS最低版本 %s 高于最高版本 %s", opts.MinVersion, opts.MaxVersion)
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// ParseTLSVersion 解析 1.0,1.1,1.2,1.3 形式的TLS版本，空字符串返回0
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("不支持的TLS版本：%s", version)
+}
+
+// TLSVersionName 返回TLS版本的名称
+func TLSVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
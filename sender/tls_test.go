@@ -0,0 +1,58 @@
+package sender
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	cert := testCertificate(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		opts     TLSOptions
+		insecure bool
+		wantErr  bool
+	}{
+		{name: "default", opts: TLSOptions{}, insecure: true},
+		{name: "verify", opts: TLSOptions{Verify: true}},
+		// 设置CA证书时即使没有 Verify 也校验证书
+		{name: "ca file", opts: TLSOptions{CAFile: caFile}},
+		{name: "missing ca file", opts: TLSOptions{CAFile: filepath.Join(t.TempDir(), "missing.pem")}, wantErr: true},
+		{name: "versions", opts: TLSOptions{MinVersion: "1.2", MaxVersion: "1.3"}, insecure: true},
+		{name: "min above max", opts: TLSOptions{MinVersion: "1.3", MaxVersion: "1.2"}, wantErr: true},
+		{name: "bad version", opts: TLSOptions{MinVersion: "2.0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := NewTLSConfig(tt.opts, "mx.example.com")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("期望返回错误")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.InsecureSkipVerify != tt.insecure {
+				t.Errorf("InsecureSkipVerify = %v，期望 %v", cfg.InsecureSkipVerify, tt.insecure)
+			}
+			if (tt.opts.CAFile != "") != (cfg.RootCAs != nil) {
+				t.Errorf("RootCAs = %v", cfg.RootCAs)
+			}
+			if cfg.ServerName != "mx.example.com" {
+				t.Errorf("ServerName = %s", cfg.ServerName)
+			}
+			if tt.opts.MinVersion == "1.2" && (cfg.MinVersion != tls.VersionTLS12 || cfg.MaxVersion != tls.VersionTLS13) {
+				t.Errorf("MinVersion = %x，MaxVersion = %x", cfg.MinVersion, cfg.MaxVersion)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package sender
+
+import (
+	"sendmail/utils"
+	"time"
+)
+
+// worker 发送邮件的工作协程，复用连接时持有一条SMTP会话
+type worker struct {
+	e *Engine
+	s *session
+}
+
+// run 处理 jobs 中的邮件直到通道关闭
+func (w *worker) run(jobs <-chan *utils.Message, results chan<- *Result) {
+	defer w.closeSession()
+	for {
+		var idle <-chan time.Time
+		var timer *time.Timer
+		if w.s != nil && w.e.cfg.IdleTimeout > 0 {
+			timer = time.NewTimer(w.e.cfg.IdleTimeout)
+			idle = timer.C
+		}
+		select {
+		case msg, ok := <-jobs:
+			if timer != nil {
+				timer.Stop()
+			}
+			if !ok {
+				return
+			}
+			results <- w.deliver(msg)
+		case <-idle:
+			w.closeSession()
+		}
+	}
+}
+
+func (w *worker) closeSession() {
+	if w.s != nil {
+		w.s.close()
+		w.s = nil
+	}
+}
+
+// connect 建立新连接，登录模式下选取轮到的账户，认证在 prepare 中进行，耗时和服务器的响应记录到 res
+func (w *worker) connect(res *Result) (Stage, error) {
+	s, stage, err := w.e.dial(&res.Timings, &res.Replies)
+	if err != nil {
+		return stage, err
+	}
+	if w.e.cfg.Login {
+		s.username, s.password = w.e.account()
+	}
+	w.s = s
+	return "", nil
+}
+
+// prepare 在发送邮件前设置客户端地址并认证。XCLIENT 必须在 AUTH 之前发送，
+// 服务器处理XCLIENT后会重置会话，之前的认证失效，因此复用连接时发送XCLIENT后需要重新认证
+func (w *worker) prepare(res *Result, clientIP string) (Stage, error) {
+	if w.e.cfg.XClient && clientIP != "" {
+		start := time.Now()
+		sent, err := w.s.xclient(clientIP)
+		res.Timings.XClient = time.Since(start)
+		if err != nil {
+			return StageXClient, err
+		}
+		if sent {
+			res.ClientIP = clientIP
+			w.s.authed = false
+		}
+	}
+	if w.e.cfg.Login && !w.s.authed {
+		start := time.Now()
+		err := w.s.auth(w.s.username, w.s.password)
+		res.Timings.Auth += time.Since(start)
+		if err != nil {
+			return StageAuth, err
+		}
+		w.s.authed = true
+	}
+	return "", nil
+}
+
+// deliver 发送一封邮件，复用连接时先发送RSET，失败则重新建立连接
+func (w *worker) deliver(msg *utils.Message) (res *Result) {
+	res = &Result{
+		Path:      msg.Path,
+		Size:      len(msg.Content),
+		FetchTime: msg.FetchDuration,
+		Start:     time.Now(),
+		LoadStage: w.e.loadStage(),
+	}
+	env := msg.Envelope
+	if env == nil && w.e.cfg.HeaderEnvelope {
+		// 邮件头无法解析时使用默认的发件人和收件人
+		env, _ = utils.ParseHeaderEnvelope(msg.Content)
+	}
+	// 信封中有收件人时不从收件人列表中取，避免占用轮换的位置
+	if env != nil && len(env.To) > 0 {
+		res.To = env.To
+	} else {
+		res.To = w.e.rcptTo()
+	}
+	w.e.cfg.Metrics.begin()
+	defer func() {
+		res.Duration = time.Since(res.Start)
+		if reply, ok := errorReply(res.Err); ok {
+			// 优先使用记录中的响应，以便带上对应的命令名
+			for i := len(res.Replies) - 1; i >= 0; i-- {
+				if res.Replies[i].Code == reply.Code && res.Replies[i].Text == reply.Text {
+					reply = res.Replies[i]
+					break
+				}
+			}
+			res.Reply = reply
+		}
+		// 之后连接上的响应不再属于这封邮件
+		if w.s != nil {
+			w.s.client.replies = nil
+		}
+		w.e.cfg.Metrics.finish(res)
+	}()
+	if w.s != nil {
+		w.s.client.replies = &res.Replies
+		start := time.Now()
+		err := w.s.reset()
+		res.Timings.Reset = time.Since(start)
+		if err != nil {
+			w.closeSession()
+		} else {
+			res.Reused = true
+		}
+	}
+	if w.s == nil {
+		res.NewConn = true
+		if stage, err := w.connect(res); err != nil {
+			res.Stage, res.Err = stage, err
+			res.ConnectTime = time.Since(res.Start)
+			return res
+		}
+	}
+	if w.e.cfg.Login {
+		res.From = w.s.username
+	} else {
+		res.From, _ = w.e.account()
+	}
+	res.Account = res.From
+	var clientIP string
+	if env != nil {
+		if env.From != "" {
+			res.From = env.From
+		}
+		clientIP = env.ClientIP
+	}
+	stage, err := w.prepare(res, clientIP)
+	if res.NewConn {
+		res.ConnectTime = time.Since(res.Start)
+	}
+	if err != nil {
+		res.Stage, res.Err = stage, err
+		w.closeSession()
+		return res
+	}
+	res.TLSVersion, res.TLSCipher = w.s.tlsState()
+	res.Pipelined, res.Chunked = w.s.pipelining, w.s.chunking
+	res.Rcpts, res.Stage, res.Err = w.s.send(res.From, res.To, msg.Content, &res.Timings)
+	if res.Err == nil {
+		res.Reply = w.s.client.last
+	}
+	w.s.count++
+	// MAIL和RCPT被拒绝时会话仍然可用，其余错误关闭连接
+	if (res.Err != nil && res.Stage != StageMail && res.Stage != StageRcpt) || w.s.count >= w.e.cfg.MessagesPerConn {
+		w.closeSession()
+	}
+	return res
+}
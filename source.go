@@ -0,0 +1,486 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sendmail/utils"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+// sourceFlags 所有发件命令共用的邮件来源参数，defaultSource 为该命令默认的来源
+func sourceFlags(defaultSource string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "source",
+			Value: defaultSource,
+			Usage: "设置邮件来源 dir,list,stdin,clickhouse,minio,manifest",
+		},
+		&cli.StringFlag{
+			Name:  "dir",
+			Value: "",
+			Usage: "设置eml文件目录",
+		},
+		&cli.StringFlag{
+			Name:  "list",
+			Value: "",
+			Usage: "设置eml文件路径列表文件，每行一个路径，- 表示从标准输入读取",
+		},
+		&cli.StringFlag{
+			Name:  "manifest",
+			Value: "",
+			Usage: "设置Export生成的manifest.jsonl清单，按清单读取邮件并还原原始信封和到达时间",
+		},
+		&cli.StringFlag{
+			Name:  "minio",
+			Value: "127.0.0.1",
+			Usage: "设置minio的IP地址",
+		},
+		&cli.IntFlag{
+			Name:  "minioPort",
+			Value: 7000,
+			Usage: "设置minio的端口",
+			Action: func(context *cli.Context, i int) error {
+				if i >= 65535 {
+					log.Info("端口必须小于65535")
+				}
+				return nil
+			},
+		},
+		&cli.StringFlag{
+			Name:  "minioUser",
+			Value: "minioadmin",
+			Usage: "设置minio用户名",
+		},
+		&cli.StringFlag{
+			Name:  "minioPassword",
+			Value: "minioadmin",
+			Usage: "设置minio密码",
+			Action: func(context *cli.Context, s string) error {
+				if s == "" {
+					log.Info("minio密码不能为空")
+				}
+				return nil
+			},
+		},
+		&cli.StringFlag{
+			Name:  "minioSessionToken",
+			Value: "",
+			Usage: "设置minio临时凭证的session token",
+		},
+		&cli.StringFlag{
+			Name:  "minioRegion",
+			Value: "",
+			Usage: "设置minio的region",
+		},
+		&cli.BoolFlag{
+			Name:  "minioSecure",
+			Value: false,
+			Usage: "使用HTTPS连接minio",
+		},
+		&cli.StringFlag{
+			Name:  "minioCAFile",
+			Value: "",
+			Usage: "设置校验minio证书使用的CA证书文件",
+		},
+		&cli.BoolFlag{
+			Name:  "minioInsecure",
+			Value: false,
+			Usage: "使用HTTPS时跳过minio证书校验",
+		},
+		&cli.StringFlag{
+			Name:  "minioBucket",
+			Value: "",
+			Usage: "设置eml文件所在的bucket，为空时取路径的第一段作为bucket",
+		},
+		&cli.StringFlag{
+			Name:  "minioKeyPrefix",
+			Value: "",
+			Usage: "设置在对象key前添加的前缀",
+		},
+		&cli.StringSliceFlag{
+			Name:  "minioMap",
+			Usage: "设置路径映射规则 路径前缀=bucket/key前缀，前缀按完整的路径段匹配，按顺序使用第一个匹配的规则，可以设置多次",
+		},
+		&cli.StringFlag{
+			Name:  "minioPrefix",
+			Value: "",
+			Usage: "来源为minio时只列举该前缀下的对象",
+		},
+		&cli.StringFlag{
+			Name:  "minioGlob",
+			Value: "",
+			Usage: "来源为minio时只重放匹配的对象，如 *.eml，不包含/时匹配文件名",
+		},
+		&cli.StringFlag{
+			Name:  "modifiedSince",
+			Value: "",
+			Usage: "来源为minio时只重放在该时间之后修改的对象，格式为 2006-01-02 15:04:05",
+		},
+		&cli.StringFlag{
+			Name:  "modifiedUntil",
+			Value: "",
+			Usage: "来源为minio时只重放在该时间之前修改的对象，格式为 2006-01-02 15:04:05",
+		},
+		&cli.IntFlag{
+			Name:  "prefetch",
+			Value: 0,
+			Usage: "设置从minio并发预读邮件的协程数，为0时与--thread相同，小于0时在派发前逐封下载",
+		},
+		&cli.IntFlag{
+			Name:  "prefetchQueue",
+			Value: 100,
+			Usage: "设置最多预读的邮件数",
+		},
+		&cli.StringFlag{
+			Name:  "cacheDir",
+			Value: "",
+			Usage: "设置本地缓存目录，从minio下载的邮件按内容摘要保存，再次重放时直接从缓存读取",
+		},
+		&cli.StringFlag{
+			Name:  "clickhouse",
+			Value: "127.0.0.1",
+			Usage: "设置clickhouse的IP地址",
+		},
+		&cli.IntFlag{
+			Name:  "ckPort",
+			Value: 9000,
+			Usage: "设置clickhouse的端口",
+			Action: func(context *cli.Context, i int) error {
+				if i >= 65535 {
+					log.Info("端口必须小于65535")
+				}
+				return nil
+			},
+		},
+		&cli.StringFlag{
+			Name:  "ckUser",
+			Value: "default",
+			Usage: "设置clickhouse的登录用户名",
+		},
+		&cli.StringFlag{
+			Name:  "ckPassword",
+			Value: "password",
+			Usage: "设置clickhouse的登录密码",
+		},
+		&cli.StringFlag{
+			Name:  "ckDatabase",
+			Value: "default",
+			Usage: "设置clickhouse中的数据库",
+		},
+		&cli.DurationFlag{
+			Name:  "ckReadTimeout",
+			Value: time.Minute,
+			Usage: "设置等待clickhouse返回数据的超时时间",
+		},
+		&cli.StringFlag{
+			Name:  "ckTable",
+			Value: "primitive_mail",
+			Usage: "设置clickhouse中保存邮件记录的表，可以是 库名.表名",
+		},
+		&cli.StringFlag{
+			Name:  "ckPathColumn",
+			Value: "emlFile",
+			Usage: "设置clickhouse中保存eml文件路径的列",
+		},
+		&cli.StringFlag{
+			Name:  "ckTimeColumn",
+			Value: "ts",
+			Usage: "设置clickhouse中的时间列",
+		},
+		&cli.StringFlag{
+			Name:  "startTime",
+			Value: "",
+			Usage: "设置clickhouse中数据的开始时间，格式为 2006-01-02 15:04:05，按时间窗口分页时必须设置",
+		},
+		&cli.StringFlag{
+			Name:  "endTime",
+			Value: time.Now().Format("2006-01-02 15:04:05"),
+			Usage: "设置clickhouse中数据的结束时间",
+		},
+		&cli.DurationFlag{
+			Name:  "ckWindow",
+			Value: time.Hour,
+			Usage: "按时间窗口分页查询clickhouse，每个查询只在发送一个窗口的邮件期间保持打开；为0时使用一个流式查询，查询在整个重放过程中保持打开，发送较慢时可能被服务器超时中断",
+		},
+		&cli.StringFlag{
+			Name:  "senderDomain",
+			Value: "",
+			Usage: "只重放该域名发出的邮件，使用--ckSenderColumn指定的列，该列经过base64编码时需要设置--ckEnvelopeBase64",
+		},
+		&cli.StringFlag{
+			Name:  "ckVerdictColumn",
+			Value: "verdict",
+			Usage: "设置clickhouse中保存判定结果的列",
+		},
+		&cli.StringSliceFlag{
+			Name:  "verdict",
+			Usage: "只重放判定结果为这些值的邮件，可以设置多次",
+		},
+		&cli.StringFlag{
+			Name:  "ckSizeColumn",
+			Value: "size",
+			Usage: "设置clickhouse中保存邮件大小的列",
+		},
+		&cli.Int64Flag{
+			Name:  "minSize",
+			Value: 0,
+			Usage: "只重放大于等于该大小的邮件，单位为字节",
+		},
+		&cli.Int64Flag{
+			Name:  "maxSize",
+			Value: 0,
+			Usage: "只重放小于等于该大小的邮件，单位为字节",
+		},
+		&cli.StringFlag{
+			Name:  "ckWhere",
+			Value: "",
+			Usage: "设置额外的查询条件，作为原始SQL写入WHERE子句，不做参数绑定和转义，只能使用可信的输入",
+		},
+		&cli.StringFlag{
+			Name:  "ckOrderBy",
+			Value: "",
+			Usage: "设置查询结果的排序列",
+		},
+		&cli.BoolFlag{
+			Name:  "ckOrderDesc",
+			Value: false,
+			Usage: "查询结果按降序排列",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Value: 0,
+			Usage: "设置最多重放的邮件数，为0时不限制",
+		},
+		&cli.Float64Flag{
+			Name:  "sample",
+			Value: 0,
+			Usage: "设置随机抽样比例，取值在0到1之间，为0时不抽样",
+		},
+		&cli.BoolFlag{
+			Name:  "replayEnvelope",
+			Value: false,
+			Usage: "使用clickhouse中保存的原始信封发送邮件",
+		},
+		&cli.StringFlag{
+			Name:  "ckSenderColumn",
+			Value: "sender",
+			Usage: "设置clickhouse中保存原始发件人的列",
+		},
+		&cli.StringFlag{
+			Name:  "ckRecipientsColumn",
+			Value: "recipients",
+			Usage: "设置clickhouse中保存原始收件人的列，支持逗号分隔的字符串或Array(String)",
+		},
+		&cli.StringFlag{
+			Name:  "ckClientIPColumn",
+			Value: "clientIP",
+			Usage: "设置clickhouse中保存原始客户端IP的列，为空时不查询",
+		},
+		&cli.BoolFlag{
+			Name:  "ckEnvelopeBase64",
+			Value: false,
+			Usage: "clickhouse中保存原始信封的列经过base64编码，同时用于--senderDomain的过滤",
+		},
+	}
+}
+
+// newSource 根据 --source 参数创建邮件来源
+func newSource(context *cli.Context) (utils.Source, error) {
+	switch context.String("source") {
+	case "dir":
+		if context.String("dir") == "" {
+			return nil, fmt.Errorf("来源为dir时必须设置--dir")
+		}
+		return utils.NewDirSource(context.String("dir"))
+	case "list":
+		if context.String("list") == "" {
+			return nil, fmt.Errorf("来源为list时必须设置--list")
+		}
+		return utils.NewListFileSource(context.String("list"))
+	case "manifest":
+		if context.String("manifest") == "" {
+			return nil, fmt.Errorf("来源为manifest时必须设置--manifest")
+		}
+		return utils.NewManifestSource(context.String("manifest"))
+	case "stdin":
+		return utils.NewReaderSource("stdin", os.Stdin), nil
+	case "clickhouse":
+		return newReplaySource(context)
+	case "minio":
+		return newMinioListSource(context)
+	default:
+		return nil, fmt.Errorf("不支持的邮件来源：%s", context.String("source"))
+	}
+}
+
+// replayQuery 根据命令行参数生成clickhouse查询条件
+func replayQuery(context *cli.Context) utils.ReplayQuery {
+	query := utils.ReplayQuery{
+		Table:         context.String("ckTable"),
+		PathColumn:    context.String("ckPathColumn"),
+		TimeColumn:    context.String("ckTimeColumn"),
+		StartTime:     context.String("startTime"),
+		EndTime:       context.String("endTime"),
+		SenderColumn:  context.String("ckSenderColumn"),
+		SenderDomain:  context.String("senderDomain"),
+		SenderBase64:  context.Bool("ckEnvelopeBase64"),
+		VerdictColumn: context.String("ckVerdictColumn"),
+		Verdicts:      context.StringSlice("verdict"),
+		SizeColumn:    context.String("ckSizeColumn"),
+		MinSize:       context.Int64("minSize"),
+		MaxSize:       context.Int64("maxSize"),
+		Where:         context.String("ckWhere"),
+		OrderBy:       context.String("ckOrderBy"),
+		OrderDesc:     context.Bool("ckOrderDesc"),
+		Limit:         context.Int("limit"),
+		Sample:        context.Float64("sample"),
+	}
+	if context.Bool("faithful") {
+		// 按原始间隔派发要求记录按到达时间升序读取
+		query.OrderBy = query.TimeColumn
+		query.OrderDesc = false
+	} else if query.OrderBy == "" && context.Command.Name == "Export" {
+		// 导出的清单可能用于 --faithful 重放，没有指定排序时按到达时间升序导出
+		query.OrderBy = query.TimeColumn
+	}
+	if context.Bool("replayEnvelope") {
+		query.Columns = utils.EnvelopeColumns{
+			Sender:     context.String("ckSenderColumn"),
+			Recipients: context.String("ckRecipientsColumn"),
+			ClientIP:   context.String("ckClientIPColumn"),
+			Base64:     context.Bool("ckEnvelopeBase64"),
+		}
+	}
+	return query
+}
+
+// newMinioReader 根据命令行参数创建minio client和路径映射规则
+func newMinioReader(context *cli.Context) (*utils.MinioReader, error) {
+	client, err := utils.NewMinioClient(utils.MinioOptions{
+		Endpoint:           context.String("minio") + ":" + strconv.Itoa(context.Int("minioPort")),
+		AccessKey:          context.String("minioUser"),
+		SecretKey:          context.String("minioPassword"),
+		SessionToken:       context.String("minioSessionToken"),
+		Region:             context.String("minioRegion"),
+		Secure:             context.Bool("minioSecure"),
+		CAFile:             context.String("minioCAFile"),
+		InsecureSkipVerify: context.Bool("minioInsecure"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	mapper := utils.ObjectMapper{
+		Bucket:    context.String("minioBucket"),
+		KeyPrefix: context.String("minioKeyPrefix"),
+	}
+	for _, value := range context.StringSlice("minioMap") {
+		rule, err := utils.ParseMapRule(value)
+		if err != nil {
+			return nil, err
+		}
+		mapper.Rules = append(mapper.Rules, rule)
+	}
+	return &utils.MinioReader{Client: client, Mapper: mapper}, nil
+}
+
+// newReplaySource 流式查询clickhouse中的eml文件路径，并从minio中读取eml文件内容
+func newReplaySource(context *cli.Context) (utils.Source, error) {
+	if context.Duration("ckWindow") > 0 && context.String("startTime") == "" {
+		return nil, fmt.Errorf("按时间窗口分页查询时需要设置--startTime，或者设置--ckWindow 0使用一个流式查询")
+	}
+	reader, err := newMinioReader(context)
+	if err != nil {
+		return nil, err
+	}
+	return openMinioSource(context, reader.Read, func(load utils.Loader) (utils.Source, error) {
+		return utils.NewClickHouseSource(utils.ClickHouseOptions{
+			Server:      context.String("clickhouse"),
+			Port:        context.Int("ckPort"),
+			Username:    context.String("ckUser"),
+			Password:    context.String("ckPassword"),
+			Database:    context.String("ckDatabase"),
+			ReadTimeout: context.Duration("ckReadTimeout"),
+		}, replayQuery(context), context.Duration("ckWindow"), load)
+	})
+}
+
+// newMinioListSource 列举minio中的对象进行重放，不需要clickhouse
+func newMinioListSource(context *cli.Context) (utils.Source, error) {
+	if context.Bool("faithful") {
+		return nil, fmt.Errorf("--faithful 不支持 --source minio：列举结果按key排序，不是到达时间顺序，可以使用clickhouse来源或按时间排序的清单")
+	}
+	reader, err := newMinioReader(context)
+	if err != nil {
+		return nil, err
+	}
+	opts := utils.MinioListOptions{
+		Bucket: context.String("minioBucket"),
+		Prefix: context.String("minioPrefix"),
+		Glob:   context.String("minioGlob"),
+	}
+	if since := context.String("modifiedSince"); since != "" {
+		if opts.Since, err = time.ParseInLocation("2006-01-02 15:04:05", since, time.Local); err != nil {
+			return nil, err
+		}
+	}
+	if until := context.String("modifiedUntil"); until != "" {
+		if opts.Until, err = time.ParseInLocation("2006-01-02 15:04:05", until, time.Local); err != nil {
+			return nil, err
+		}
+	}
+	// 列举得到的路径为 /bucket/key，不使用路径映射规则
+	plain := &utils.MinioReader{Client: reader.Client}
+	return openMinioSource(context, plain.Read, func(load utils.Loader) (utils.Source, error) {
+		return utils.NewMinioListSource(reader.Client, opts, load)
+	})
+}
+
+// openMinioSource 按 --cacheDir 和 --prefetch 包装从minio读取邮件的来源，
+// open 使用传入的 Loader 创建来源，开启预读时传入 nil 由预读协程读取内容
+func openMinioSource(context *cli.Context, load utils.Loader, open func(load utils.Loader) (utils.Source, error)) (utils.Source, error) {
+	var cache *utils.Cache
+	if dir := context.String("cacheDir"); dir != "" {
+		var err error
+		if cache, err = utils.NewCache(dir, load); err != nil {
+			return nil, err
+		}
+		log.Info("邮件缓存目录为：", dir)
+		load = cache.Load
+	}
+	// 逐封下载时派发协程会等待下载完成，发送线程无法并发，因此默认预读协程数与发送线程数相同
+	workers := context.Int("prefetch")
+	if workers == 0 {
+		workers = context.Int("thread")
+	}
+	var src utils.Source
+	var err error
+	if workers > 0 {
+		if src, err = open(nil); err != nil {
+			return nil, err
+		}
+		log.Infof("预读协程数：%d,预读队列长度：%d", workers, context.Int("prefetchQueue"))
+		src = utils.NewPrefetchSource(src, load, workers, context.Int("prefetchQueue"))
+	} else if src, err = open(load); err != nil {
+		return nil, err
+	}
+	if cache != nil {
+		src = &cacheSource{Source: src, cache: cache}
+	}
+	return src, nil
+}
+
+// cacheSource 关闭来源时输出缓存命中情况
+type cacheSource struct {
+	utils.Source
+	cache *utils.Cache
+}
+
+func (s *cacheSource) Close() error {
+	hits, misses := s.cache.Stats()
+	log.Infof("邮件缓存命中：%d 封,未命中：%d 封", hits, misses)
+	return s.Source.Close()
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Cache 按内容寻址的本地邮件缓存，
+// 邮件内容保存在 objects/前两位/sha256 中，路径到内容摘要的索引保存在 index/前两位/路径的sha256 中，
+// 多个路径内容相同时只保存一份
+type Cache struct {
+	dir    string
+	load   Loader
+	hits   uint64
+	misses uint64
+}
+
+// NewCache 创建缓存目录，未命中缓存时通过 load 读取并写入缓存
+func NewCache(dir string, load Loader) (*Cache, error) {
+	for _, sub := range []string{"objects", "index"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Cache{dir: dir, load: load}, nil
+}
+
+func hashPath(dir, sub, sum string) string {
+	return filepath.Join(dir, sub, sum[:2], sum)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Load 优先从缓存读取邮件内容，可以作为 Loader 使用
+func (c *Cache) Load(path string) ([]byte, error) {
+	index := hashPath(c.dir, "index", sha256Hex([]byte(path)))
+	if digest, err := os.ReadFile(index); err == nil {
+		sum := strings.TrimSpace(string(digest))
+		if content, err := os.ReadFile(hashPath(c.dir, "objects", sum)); err == nil && sha256Hex(content) == sum {
+			atomic.AddUint64(&c.hits, 1)
+			return content, nil
+		}
+	}
+	atomic.AddUint64(&c.misses, 1)
+	content, err := c.load(path)
+	if err != nil {
+		return nil, err
+	}
+	// 写入缓存失败不影响发送
+	sum := sha256Hex(content)
+	if writeFileAtomic(hashPath(c.dir, "objects", sum), content) == nil {
+		writeFileAtomic(index, []byte(sum))
+	}
+	return content, nil
+}
+
+// Stats 返回缓存命中和未命中的次数
+func (c *Cache) Stats() (uint64, uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// writeFileAtomic 先写入临时文件再重命名，避免并发读取到不完整的文件
+func writeFileAtomic(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
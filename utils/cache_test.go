@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	dir := t.TempDir()
+	contents := map[string]string{"/eml/a.eml": "same", "/eml/b.eml": "same", "/eml/c.eml": "other"}
+	var loads int32
+	cache, err := NewCache(dir, func(path string) ([]byte, error) {
+		atomic.AddInt32(&loads, 1)
+		content, ok := contents[path]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return []byte(content), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := func(path, want string) {
+		t.Helper()
+		content, err := cache.Load(path)
+		if err != nil || string(content) != want {
+			t.Fatalf("Load(%s) = %q, %v，期望 %q", path, content, err, want)
+		}
+	}
+	for path, content := range contents {
+		load(path, content)
+		load(path, content)
+	}
+	if hits, misses := cache.Stats(); hits != 3 || misses != 3 || loads != 3 {
+		t.Errorf("命中 %d 次，未命中 %d 次，读取 %d 次，期望 3,3,3", hits, misses, loads)
+	}
+	// 内容相同的路径只保存一份，没有残留的临时文件
+	objects, _ := filepath.Glob(filepath.Join(dir, "objects", "*", "*"))
+	if len(objects) != 2 {
+		t.Errorf("缓存中有 %d 个对象，期望 2 个：%v", len(objects), objects)
+	}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if strings.HasPrefix(filepath.Base(path), ".tmp-") {
+			t.Errorf("残留临时文件 %s", path)
+		}
+		return nil
+	})
+
+	// 缓存的内容被破坏时重新读取并覆盖
+	object := hashPath(dir, "objects", sha256Hex([]byte("other")))
+	if err := os.WriteFile(object, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	load("/eml/c.eml", "other")
+	if data, _ := os.ReadFile(object); string(data) != "other" {
+		t.Errorf("被破坏的对象没有重新写入：%q", data)
+	}
+	if _, misses := cache.Stats(); misses != 4 {
+		t.Errorf("未命中 %d 次，期望 4 次", misses)
+	}
+
+	// 读取失败时不写入缓存
+	if _, err := cache.Load("/eml/missing.eml"); err == nil {
+		t.Error("读取不存在的邮件应当返回错误")
+	}
+	if _, err := os.Stat(hashPath(dir, "index", sha256Hex([]byte("/eml/missing.eml")))); !os.IsNotExist(err) {
+		t.Errorf("读取失败的路径写入了索引：%v", err)
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	// 多个协程同时读取和写入同一个路径，读取到的内容总是完整的
+	dir := t.TempDir()
+	content := strings.Repeat("x", 1<<20)
+	cache, err := NewCache(dir, func(string) ([]byte, error) { return []byte(content), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				data, err := cache.Load("/eml/big.eml")
+				if err != nil || len(data) != len(content) {
+					t.Errorf("读取到 %d 字节，错误为 %v", len(data), err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if hits, misses := cache.Stats(); hits+misses != 80 || hits == 0 {
+		t.Errorf("命中 %d 次，未命中 %d 次", hits, misses)
+	}
+}
@@ -0,0 +1,340 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uptrace/go-clickhouse/ch"
+)
+
+// ClickHouseOptions clickhouse连接配置
+type ClickHouseOptions struct {
+	Server   string
+	Port     int
+	Username string
+	Password string
+	Database string
+	// ReadTimeout 等待clickhouse返回数据的超时时间，为0时使用5秒
+	ReadTimeout time.Duration
+}
+
+// EnvelopeColumns primitive_mail中保存原始信封的列，列名为空表示不查询该列
+type EnvelopeColumns struct {
+	Sender     string
+	Recipients string
+	ClientIP   string
+	// Base64 为 true 时这些列与emlFile一样经过base64编码
+	Base64 bool
+}
+
+// ReplayRecord clickhouse中记录的一封邮件
+type ReplayRecord struct {
+	// Path eml文件在minio中的路径
+	Path string
+	// Envelope 原始信封，没有查询信封列时为 nil
+	Envelope *Envelope
+	// Timestamp 时间列记录的到达时间
+	Timestamp time.Time
+}
+
+func connectClickHouse(opts ClickHouseOptions) *ch.DB {
+	dsn := "clickhouse://" + opts.Username + ":" + opts.Password + "@" + opts.Server + ":" + strconv.Itoa(opts.Port) + "/" + opts.Database + "?sslmode=disable"
+	readTimeout := opts.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = 5 * time.Second
+	}
+	return ch.Connect(ch.WithDSN(dsn), ch.WithTimeout(5*time.Second), ch.WithDialTimeout(5*time.Second), ch.WithReadTimeout(readTimeout), ch.WithWriteTimeout(5*time.Second), ch.WithPoolSize(100))
+}
+
+// ReplayQuery 重放时查询clickhouse的条件，除 Where 外所有取值都以参数绑定的方式写入SQL
+type ReplayQuery struct {
+	// Table 表名，可以是 库名.表名，默认为 primitive_mail
+	Table string
+	// PathColumn 保存base64编码的eml文件路径的列，默认为 emlFile
+	PathColumn string
+	// TimeColumn 时间列，默认为 ts
+	TimeColumn string
+	// StartTime 和 EndTime 为 2006-01-02 15:04:05 格式，为空时不限制
+	StartTime string
+	EndTime   string
+	// Columns 需要查询的原始信封列
+	Columns EnvelopeColumns
+	// SenderColumn 和 SenderDomain 不为空时只查询该域名发出的邮件，SenderBase64 为 true 时发件人列经过base64编码
+	SenderColumn string
+	SenderDomain string
+	SenderBase64 bool
+	// VerdictColumn 和 Verdicts 不为空时只查询判定结果为其中之一的邮件
+	VerdictColumn string
+	Verdicts      []string
+	// SizeColumn 不为空时按邮件大小过滤，MinSize 和 MaxSize 为0表示不限制
+	SizeColumn string
+	MinSize    int64
+	MaxSize    int64
+	// Where 额外的过滤条件，原样写入SQL，不做参数绑定和转义，只能使用可信的输入
+	Where string
+	// OrderBy 排序列，为空时不排序
+	OrderBy   string
+	OrderDesc bool
+	// Limit 大于0时最多查询的条数
+	Limit int
+	// Sample 在0到1之间时按比例随机抽样
+	Sample float64
+	// endExclusive 为 true 时结束时间不包含在内，用于按时间窗口分页
+	endExclusive bool
+}
+
+func (q ReplayQuery) withDefaults() ReplayQuery {
+	if q.Table == "" {
+		q.Table = "primitive_mail"
+	}
+	if q.PathColumn == "" {
+		q.PathColumn = "emlFile"
+	}
+	if q.TimeColumn == "" {
+		q.TimeColumn = "ts"
+	}
+	return q
+}
+
+// tableIdent 将 库名.表名 转换为标识符
+func tableIdent(table string) interface{} {
+	if db, name, ok := strings.Cut(table, "."); ok {
+		return ch.SafeQuery("?.?", ch.Ident(db), ch.Ident(name))
+	}
+	return ch.Ident(table)
+}
+
+// columnExpr 返回转换为字符串的列，base64 为 true 时先解码
+func columnExpr(column string, base64 bool) interface{} {
+	if base64 {
+		return ch.SafeQuery("tryBase64Decode(toString(?))", ch.Ident(column))
+	}
+	return ch.SafeQuery("toString(?)", ch.Ident(column))
+}
+
+// Build 生成查询语句和参数，查询的列依次为 路径、发件人、收件人、客户端IP、毫秒时间戳
+func (q ReplayQuery) Build() (string, []interface{}) {
+	q = q.withDefaults()
+	query := "SELECT ?, ?, ?, ?, ? FROM ?"
+	args := []interface{}{ch.Ident(q.PathColumn)}
+	for _, column := range []string{q.Columns.Sender, q.Columns.Recipients, q.Columns.ClientIP} {
+		if column == "" {
+			args = append(args, ch.Safe("''"))
+		} else {
+			args = append(args, ch.SafeQuery("toString(?)", ch.Ident(column)))
+		}
+	}
+	args = append(args, ch.SafeQuery("toUnixTimestamp64Milli(toDateTime64(?, 3))", ch.Ident(q.TimeColumn)))
+	args = append(args, tableIdent(q.Table))
+	var conds []string
+	if q.StartTime != "" {
+		conds = append(conds, "? >= ?")
+		args = append(args, ch.Ident(q.TimeColumn), q.StartTime)
+	}
+	if q.EndTime != "" && q.endExclusive {
+		conds = append(conds, "? < ?")
+		args = append(args, ch.Ident(q.TimeColumn), q.EndTime)
+	} else if q.EndTime != "" {
+		conds = append(conds, "? <= ?")
+		args = append(args, ch.Ident(q.TimeColumn), q.EndTime)
+	}
+	if q.SenderColumn != "" && q.SenderDomain != "" {
+		conds = append(conds, "endsWith(lower(trim(BOTH '<>' FROM ?)), ?)")
+		args = append(args, columnExpr(q.SenderColumn, q.SenderBase64), "@"+strings.ToLower(strings.TrimPrefix(q.SenderDomain, "@")))
+	}
+	if q.VerdictColumn != "" && len(q.Verdicts) > 0 {
+		conds = append(conds, "toString(?) IN (?)")
+		args = append(args, ch.Ident(q.VerdictColumn), ch.In(q.Verdicts))
+	}
+	if q.SizeColumn != "" && q.MinSize > 0 {
+		conds = append(conds, "? >= ?")
+		args = append(args, ch.Ident(q.SizeColumn), q.MinSize)
+	}
+	if q.SizeColumn != "" && q.MaxSize > 0 {
+		conds = append(conds, "? <= ?")
+		args = append(args, ch.Ident(q.SizeColumn), q.MaxSize)
+	}
+	if q.Sample > 0 && q.Sample < 1 {
+		conds = append(conds, "rand() % 1000000 < ?")
+		args = append(args, int64(q.Sample*1000000))
+	}
+	if q.Where != "" {
+		conds = append(conds, "(?)")
+		args = append(args, ch.Safe(q.Where))
+	}
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if q.OrderBy != "" {
+		query += " ORDER BY ?"
+		args = append(args, ch.Ident(q.OrderBy))
+		if q.OrderDesc {
+			query += " DESC"
+		}
+	}
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	return query, args
+}
+
+// scanReplayRecord 读取查询结果中的一行
+func scanReplayRecord(rows *ch.Rows, columns EnvelopeColumns) (*ReplayRecord, error) {
+	var emlFilePath *string
+	var sender, recipients, clientIP string
+	var timestamp int64
+	if err := rows.Scan(&emlFilePath, &sender, &recipients, &clientIP, &timestamp); err != nil {
+		return nil, err
+	}
+	record := &ReplayRecord{Path: decodeBase64(toString(emlFilePath))}
+	if timestamp > 0 {
+		record.Timestamp = time.Unix(0, timestamp*int64(time.Millisecond))
+	}
+	if columns.Sender != "" || columns.Recipients != "" || columns.ClientIP != "" {
+		if columns.Base64 {
+			sender, recipients, clientIP = decodeBase64(sender), decodeBase64(recipients), decodeBase64(clientIP)
+		}
+		record.Envelope = &Envelope{
+			From:     strings.Trim(strings.TrimSpace(sender), "<>"),
+			To:       splitRecipients(recipients),
+			ClientIP: strings.TrimSpace(clientIP),
+		}
+	}
+	return record, nil
+}
+
+// splitRecipients 拆分收件人列，兼容逗号或分号分隔的字符串以及Array(String)转换后的 ['a','b'] 格式
+func splitRecipients(value string) []string {
+	value = strings.Trim(strings.TrimSpace(value), "[]")
+	var recipients []string
+	for _, addr := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t'
+	}) {
+		if addr = strings.Trim(addr, `'"<>`); addr != "" {
+			recipients = append(recipients, addr)
+		}
+	}
+	return recipients
+}
+
+// clickHouseTimeLayout clickhouse中时间条件的格式
+const clickHouseTimeLayout = "2006-01-02 15:04:05"
+
+type clickHouseSource struct {
+	db    *ch.DB
+	query ReplayQuery
+	load  Loader
+	rows  *ch.Rows
+	// window 大于0时按时间窗口分页，next 为下一个窗口的开始时间
+	window time.Duration
+	next   time.Time
+	end    time.Time
+	// count 已经读取的记录数，用于在分页时遵守 Limit
+	count int
+	done  bool
+}
+
+// NewClickHouseSource 读取clickhouse的查询结果并通过 load 读取eml文件，不会预先加载整个结果集。
+// window 大于0时将 StartTime 到 EndTime 按该时长切分为多个窗口依次流式查询，每个查询只在读取一个窗口期间保持打开，
+// 此时必须设置 StartTime；window 为0时使用一个流式查询，查询在整个重放过程中保持打开，
+// 发送较慢时可能因服务器的 send_timeout 中断。load 为 nil 时只返回路径和信封，由 NewPrefetchSource 读取内容
+func NewClickHouseSource(opts ClickHouseOptions, query ReplayQuery, window time.Duration, load Loader) (Source, error) {
+	s := &clickHouseSource{query: query, window: window, load: load}
+	if window > 0 {
+		if query.StartTime == "" {
+			return nil, fmt.Errorf("按时间窗口分页时需要设置开始时间")
+		}
+		var err error
+		if s.next, err = time.ParseInLocation(clickHouseTimeLayout, query.StartTime, time.UTC); err != nil {
+			return nil, fmt.Errorf("按时间窗口分页时开始时间格式错误：%v", err)
+		}
+		if s.end, err = time.ParseInLocation(clickHouseTimeLayout, query.EndTime, time.UTC); err != nil {
+			return nil, fmt.Errorf("按时间窗口分页时结束时间格式错误：%v", err)
+		}
+	}
+	s.db = connectClickHouse(opts)
+	return s, nil
+}
+
+// open 执行下一个窗口的查询，没有更多窗口时返回 false
+func (s *clickHouseSource) open() (bool, error) {
+	if s.done || (s.query.Limit > 0 && s.count >= s.query.Limit) {
+		return false, nil
+	}
+	query := s.query
+	if s.window > 0 {
+		if s.next.After(s.end) {
+			return false, nil
+		}
+		windowEnd := s.next.Add(s.window)
+		if !windowEnd.Before(s.end) {
+			windowEnd = s.end
+			s.done = true
+		} else {
+			query.endExclusive = true
+		}
+		query.StartTime = s.next.Format(clickHouseTimeLayout)
+		query.EndTime = windowEnd.Format(clickHouseTimeLayout)
+		if query.Limit > 0 {
+			query.Limit -= s.count
+		}
+		s.next = windowEnd
+	} else {
+		s.done = true
+	}
+	sql, args := query.Build()
+	rows, err := s.db.Query(sql, args...)
+	if err != nil {
+		return false, err
+	}
+	s.rows = rows
+	return true, nil
+}
+
+// nextRecord 返回下一条记录，所有窗口都读取完毕时返回 io.EOF
+func (s *clickHouseSource) nextRecord() (*ReplayRecord, error) {
+	for {
+		if s.rows == nil {
+			ok, err := s.open()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, io.EOF
+			}
+		}
+		if s.rows.Next() {
+			s.count++
+			return scanReplayRecord(s.rows, s.query.Columns)
+		}
+		err := s.rows.Err()
+		s.rows.Close()
+		s.rows = nil
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *clickHouseSource) Next() (*Message, error) {
+	record, err := s.nextRecord()
+	if err != nil {
+		return nil, err
+	}
+	msg := &Message{Path: record.Path, Envelope: record.Envelope, Timestamp: record.Timestamp}
+	if s.load == nil {
+		return msg, nil
+	}
+	return msg, loadContent(msg, s.load)
+}
+
+func (s *clickHouseSource) Close() error {
+	if s.rows != nil {
+		s.rows.Close()
+	}
+	return s.db.Close()
+}
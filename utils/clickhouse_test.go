@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/uptrace/go-clickhouse/ch/chschema"
+)
+
+func TestReplayQueryBuild(t *testing.T) {
+	tests := []struct {
+		name  string
+		query ReplayQuery
+		// contains 和 excludes 为格式化后的SQL中应当包含和不应包含的片段
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "defaults",
+			query:    ReplayQuery{StartTime: "2024-01-01 00:00:00"},
+			contains: []string{`FROM "primitive_mail"`, `WHERE "ts" >= '2024-01-01 00:00:00'`},
+			excludes: []string{"ORDER BY", "LIMIT"},
+		},
+		{
+			// 没有查询原始信封时发件人过滤仍按 SenderBase64 解码
+			name:     "sender domain base64",
+			query:    ReplayQuery{SenderColumn: "sender", SenderDomain: "Example.com", SenderBase64: true},
+			contains: []string{`endsWith(lower(trim(BOTH '<>' FROM tryBase64Decode(toString("sender")))), '@example.com')`},
+		},
+		{
+			name:     "sender domain plain",
+			query:    ReplayQuery{SenderColumn: "sender", SenderDomain: "@example.com", Columns: EnvelopeColumns{Base64: true}},
+			contains: []string{`FROM toString("sender"))), '@example.com')`},
+			excludes: []string{"tryBase64Decode"},
+		},
+		{
+			name:     "values are bound",
+			query:    ReplayQuery{Verdicts: []string{"spam", "x' OR 1=1 --"}, VerdictColumn: "verdict"},
+			contains: []string{`toString("verdict") IN ('spam', 'x\' OR 1=1 --')`},
+		},
+		{
+			name:     "raw where",
+			query:    ReplayQuery{Where: "size > 10", OrderBy: "ts", Limit: 5},
+			contains: []string{"(size > 10)", `ORDER BY "ts"`, "LIMIT 5"},
+		},
+	}
+	formatter := chschema.NewFormatter()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := tt.query.Build()
+			sql := formatter.FormatQuery(query, args...)
+			for _, s := range tt.contains {
+				if !strings.Contains(sql, s) {
+					t.Errorf("SQL中没有 %s：%s", s, sql)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(sql, s) {
+					t.Errorf("SQL中不应有 %s：%s", s, sql)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitRecipients(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"a@x.com", "a@x.com"},
+		{"a@x.com, b@x.com;c@x.com", "a@x.com|b@x.com|c@x.com"},
+		{"['a@x.com','<b@x.com>']", "a@x.com|b@x.com"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(splitRecipients(tt.in), "|"); got != tt.want {
+			t.Errorf("splitRecipients(%q) = %q，期望 %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewClickHouseSourceWindow(t *testing.T) {
+	if _, err := NewClickHouseSource(ClickHouseOptions{}, ReplayQuery{EndTime: "2024-01-01 00:00:00"}, time.Hour, nil); err == nil {
+		t.Error("按时间窗口分页时没有开始时间应当返回错误")
+	}
+	if _, err := NewClickHouseSource(ClickHouseOptions{}, ReplayQuery{StartTime: "2024-01-01", EndTime: "2024-01-01 00:00:00"}, time.Hour, nil); err == nil {
+		t.Error("开始时间格式错误时应当返回错误")
+	}
+}
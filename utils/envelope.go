@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"bytes"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// 发件人和收件人使用的邮件头，按优先级排列
+var (
+	senderHeaders    = []string{"Return-Path", "Sender", "From"}
+	recipientHeaders = []string{"To", "Cc", "Bcc", "Delivered-To", "X-Original-To"}
+)
+
+// addrPattern 邮件头无法按RFC 5322解析时，用于提取其中的邮件地址
+var addrPattern = regexp.MustCompile(`[^\s<>,;:"'()\[\]]+@[^\s<>,;:"'()\[\]]+`)
+
+// ParseHeaderEnvelope 根据邮件头生成信封，
+// 发件人取 Return-Path、Sender、From 中第一个有效地址，Return-Path 为 <> 时跳过，
+// 收件人为 To、Cc、Bcc、Delivered-To、X-Original-To 中的所有地址并去重
+func ParseHeaderEnvelope(content []byte) (*Envelope, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	env := &Envelope{}
+	for _, name := range senderHeaders {
+		if addrs := parseAddresses(msg.Header[name]); len(addrs) > 0 {
+			env.From = addrs[0]
+			break
+		}
+	}
+	seen := map[string]bool{}
+	for _, name := range recipientHeaders {
+		for _, addr := range parseAddresses(msg.Header[name]) {
+			key := strings.ToLower(addr)
+			if !seen[key] {
+				seen[key] = true
+				env.To = append(env.To, addr)
+			}
+		}
+	}
+	return env, nil
+}
+
+// parseAddresses 解析邮件头中的地址列表，解析失败时退化为正则提取
+func parseAddresses(values []string) []string {
+	var addrs []string
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		list, err := mail.ParseAddressList(value)
+		if err != nil {
+			addrs = append(addrs, addrPattern.FindAllString(value, -1)...)
+			continue
+		}
+		for _, addr := range list {
+			addrs = append(addrs, addr.Address)
+		}
+	}
+	return addrs
+}
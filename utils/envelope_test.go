@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHeaderEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    Envelope
+		wantErr bool
+	}{
+		{
+			name:   "display names",
+			header: "From: \"Doe, John\" <john@example.com>\r\nTo: Alice <alice@example.com>\r\n",
+			want:   Envelope{From: "john@example.com", To: []string{"alice@example.com"}},
+		},
+		{
+			name:   "multiple to and cc",
+			header: "From: a@example.com\r\nTo: b@example.com, Carol <c@example.com>\r\nCc: d@example.com, B@example.com\r\nBcc: e@example.com\r\n",
+			want:   Envelope{From: "a@example.com", To: []string{"b@example.com", "c@example.com", "d@example.com", "e@example.com"}},
+		},
+		{
+			name:   "folded header",
+			header: "From: a@example.com\r\nTo: b@example.com,\r\n  Carol\r\n <c@example.com>\r\n",
+			want:   Envelope{From: "a@example.com", To: []string{"b@example.com", "c@example.com"}},
+		},
+		{
+			// Return-Path 为 <> 时跳过，按 Sender 和 From 的顺序选择发件人
+			name:   "sender priority",
+			header: "Return-Path: <>\r\nSender: s@example.com\r\nFrom: a@example.com\r\nTo: b@example.com\r\n",
+			want:   Envelope{From: "s@example.com", To: []string{"b@example.com"}},
+		},
+		{
+			name:   "missing from",
+			header: "To: b@example.com\r\nDelivered-To: x@example.com\r\n",
+			want:   Envelope{To: []string{"b@example.com", "x@example.com"}},
+		},
+		{
+			// 不符合RFC 5322的地址列表退化为正则提取
+			name:   "fallback",
+			header: "From: John Doe john@example.com\r\nTo: <b@example.com>; \"c@example.com\" (broken\r\n",
+			want:   Envelope{From: "john@example.com", To: []string{"b@example.com", "c@example.com"}},
+		},
+		{
+			name:   "no addresses",
+			header: "Subject: hello\r\n",
+			want:   Envelope{},
+		},
+		{
+			name:    "invalid header",
+			header:  "not a header line\r\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, err := ParseHeaderEnvelope([]byte(tt.header + "\r\nbody\r\n"))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("期望返回错误，得到 %+v", env)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*env, tt.want) {
+				t.Errorf("ParseHeaderEnvelope = %+v，期望 %+v", *env, tt.want)
+			}
+		})
+	}
+}
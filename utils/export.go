@@ -0,0 +1,323 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ManifestName 导出清单的文件名
+const ManifestName = "manifest.jsonl"
+
+// ManifestEntry 导出清单中的一行，记录导出的文件与原始邮件的对应关系
+type ManifestEntry struct {
+	// File 导出后相对于导出目录的路径
+	File string `json:"file"`
+	// Path 邮件在对象存储中的原始路径
+	Path string `json:"path"`
+	// Timestamp 邮件原始的到达时间，RFC3339格式，没有时为空
+	Timestamp string    `json:"timestamp,omitempty"`
+	Envelope  *Envelope `json:"envelope,omitempty"`
+	Size      int       `json:"size"`
+}
+
+func newManifestEntry(msg *Message) ManifestEntry {
+	entry := ManifestEntry{File: exportName(msg.Path), Path: msg.Path, Envelope: msg.Envelope, Size: len(msg.Content)}
+	if !msg.Timestamp.IsZero() {
+		entry.Timestamp = msg.Timestamp.Format(time.RFC3339Nano)
+	}
+	return entry
+}
+
+// exportName 将原始路径转换为导出目录中的相对路径，保证以 .eml 结尾以便 --source dir 读取
+func exportName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+	if name == "" {
+		name = "unnamed"
+	}
+	if path.Ext(name) != ".eml" {
+		name += ".eml"
+	}
+	return name
+}
+
+// exportNames 记录已经导出的文件名，保证不同的原始路径不会导出为同一个文件
+type exportNames struct {
+	// files 原始路径对应的导出文件名
+	files map[string]string
+	// used 已经占用的导出文件名
+	used map[string]bool
+}
+
+func newExportNames() *exportNames {
+	return &exportNames{files: map[string]string{}, used: map[string]bool{}}
+}
+
+// lookup 返回原始路径已经导出的文件名，同一路径重复出现时不再重复写入内容
+func (n *exportNames) lookup(path string) (string, bool) {
+	file, ok := n.files[path]
+	return file, ok
+}
+
+// next 返回一个还没有占用的文件名，name 已被占用时依次尝试 name-1.eml、name-2.eml……
+func (n *exportNames) next(name string) string {
+	file := name
+	for i := 1; n.used[file]; i++ {
+		file = fmt.Sprintf("%s-%d.eml", strings.TrimSuffix(name, ".eml"), i)
+	}
+	return file
+}
+
+// add 记录原始路径导出的文件名
+func (n *exportNames) add(path, file string) {
+	n.files[path] = file
+	n.reserve(file)
+}
+
+// reserve 将文件名标记为已占用
+func (n *exportNames) reserve(file string) {
+	n.used[file] = true
+}
+
+// Exporter 将邮件导出到本地并记录导出清单
+type Exporter interface {
+	Export(msg *Message) error
+	Close() error
+}
+
+type dirExporter struct {
+	dir      string
+	manifest *os.File
+	encoder  *json.Encoder
+	names    *exportNames
+}
+
+// NewDirExporter 将邮件按原始路径保存到 dir 中，清单写入 dir/manifest.jsonl，
+// 不覆盖已有的文件，文件名冲突时添加 -1、-2 等后缀
+func NewDirExporter(dir string) (Exporter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	manifest, err := os.Create(filepath.Join(dir, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	return &dirExporter{dir: dir, manifest: manifest, encoder: json.NewEncoder(manifest), names: newExportNames()}, nil
+}
+
+func (e *dirExporter) Export(msg *Message) error {
+	entry := newManifestEntry(msg)
+	if file, ok := e.names.lookup(msg.Path); ok {
+		entry.File = file
+		return e.encoder.Encode(entry)
+	}
+	name := entry.File
+	for {
+		entry.File = e.names.next(name)
+		err := e.writeFile(entry.File, msg)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		// 目录中已有同名文件，换一个文件名
+		e.names.reserve(entry.File)
+	}
+	e.names.add(msg.Path, entry.File)
+	return e.encoder.Encode(entry)
+}
+
+// writeFile 以 O_EXCL 创建文件并写入邮件内容，文件已存在时返回 os.ErrExist
+func (e *dirExporter) writeFile(file string, msg *Message) error {
+	name := filepath.Join(e.dir, filepath.FromSlash(file))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(msg.Content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if !msg.Timestamp.IsZero() {
+		os.Chtimes(name, msg.Timestamp, msg.Timestamp)
+	}
+	return nil
+}
+
+func (e *dirExporter) Close() error {
+	return e.manifest.Close()
+}
+
+type tarExporter struct {
+	file *os.File
+	gzip *gzip.Writer
+	tar  *tar.Writer
+	// manifest 清单的临时文件，tar中每个文件都需要预先知道大小，因此清单先写入临时文件，关闭时再写入归档
+	manifest *os.File
+	encoder  *json.Encoder
+	// names 已经写入的文件，同一路径重复出现时只写入一次内容
+	names *exportNames
+	// err 写入归档失败的错误，失败后归档已经损坏，之后的导出都返回该错误
+	err error
+}
+
+// NewTarExporter 将邮件写入tar归档，文件名以 .gz 或 .tgz 结尾时使用gzip压缩，
+// 清单在关闭时作为 manifest.jsonl 写入归档末尾，写入失败后不再继续写入，关闭时删除损坏的归档
+func NewTarExporter(name string) (Exporter, error) {
+	manifest, err := os.CreateTemp("", "manifest-*.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		manifest.Close()
+		os.Remove(manifest.Name())
+		return nil, err
+	}
+	e := &tarExporter{file: file, manifest: manifest, encoder: json.NewEncoder(manifest), names: newExportNames()}
+	var w io.Writer = file
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		e.gzip = gzip.NewWriter(file)
+		w = e.gzip
+	}
+	e.tar = tar.NewWriter(w)
+	return e, nil
+}
+
+func (e *tarExporter) Export(msg *Message) error {
+	if e.err != nil {
+		return e.err
+	}
+	entry := newManifestEntry(msg)
+	if file, ok := e.names.lookup(msg.Path); ok {
+		entry.File = file
+		return e.encoder.Encode(entry)
+	}
+	modTime := msg.Timestamp
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	entry.File = e.names.next(entry.File)
+	if err := e.writeFile(entry.File, msg.Content, modTime); err != nil {
+		e.err = fmt.Errorf("写入归档失败：%v", err)
+		return e.err
+	}
+	e.names.add(msg.Path, entry.File)
+	return e.encoder.Encode(entry)
+}
+
+func (e *tarExporter) writeFile(name string, content []byte, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := e.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := e.tar.Write(content)
+	return err
+}
+
+// writeManifest 将临时文件中的清单写入归档
+func (e *tarExporter) writeManifest() error {
+	size, err := e.manifest.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := e.manifest.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := &tar.Header{Name: ManifestName, Mode: 0644, Size: size, ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := e.tar.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(e.tar, e.manifest)
+	return err
+}
+
+func (e *tarExporter) Close() error {
+	err := e.err
+	if err == nil {
+		err = e.writeManifest()
+	}
+	if closeErr := e.manifest.Close(); err == nil {
+		err = closeErr
+	}
+	os.Remove(e.manifest.Name())
+	if closeErr := e.tar.Close(); err == nil {
+		err = closeErr
+	}
+	if e.gzip != nil {
+		if closeErr := e.gzip.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := e.file.Close(); err == nil {
+		err = closeErr
+	}
+	if e.err != nil {
+		os.Remove(e.file.Name())
+	}
+	return err
+}
+
+type manifestSource struct {
+	dir     string
+	file    *os.File
+	scanner *bufio.Scanner
+}
+
+// NewManifestSource 按导出清单读取导出目录中的邮件，还原原始路径、信封和到达时间
+func NewManifestSource(name string) (Source, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return &manifestSource{dir: filepath.Dir(name), file: file, scanner: scanner}, nil
+}
+
+func (s *manifestSource) Next() (*Message, error) {
+	for s.scanner.Scan() {
+		line := bytes.TrimSpace(s.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry ManifestEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return &Message{Path: string(line)}, err
+		}
+		msg := &Message{Path: entry.Path, Envelope: entry.Envelope}
+		if msg.Path == "" {
+			msg.Path = entry.File
+		}
+		if entry.Timestamp != "" {
+			msg.Timestamp, _ = time.Parse(time.RFC3339Nano, entry.Timestamp)
+		}
+		var err error
+		msg.Content, err = ReadEmlFile(filepath.Join(s.dir, filepath.FromSlash(entry.File)))
+		return msg, err
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (s *manifestSource) Close() error {
+	return s.file.Close()
+}
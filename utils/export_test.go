@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTarExporter(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "replay.tgz")
+	exporter, err := NewTarExporter(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []*Message{
+		{Path: "/eml/a/1.eml", Content: []byte("Subject: 1\r\n\r\none\r\n"), Timestamp: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Path: "/eml/a/2", Content: []byte("Subject: 2\r\n\r\ntwo\r\n"), Envelope: &Envelope{From: "a@x.com", To: []string{"b@x.com"}}},
+		// 重复的路径只写入一次内容，但清单中记录两次
+		{Path: "/eml/a/1.eml", Content: []byte("Subject: 1\r\n\r\none\r\n")},
+	}
+	for _, msg := range messages {
+		if err := exporter.Export(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	var names []string
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = content
+		names = append(names, header.Name)
+	}
+	if got := strings.Join(names, ","); got != "eml/a/1.eml,eml/a/2.eml,"+ManifestName {
+		t.Fatalf("归档中的文件为 %s", got)
+	}
+	if !bytes.Equal(files["eml/a/2.eml"], messages[1].Content) {
+		t.Errorf("eml/a/2.eml 的内容为 %q", files["eml/a/2.eml"])
+	}
+	lines := strings.Split(strings.TrimSpace(string(files[ManifestName])), "\n")
+	if len(lines) != len(messages) {
+		t.Fatalf("清单有 %d 行，期望 %d 行：%s", len(lines), len(messages), files[ManifestName])
+	}
+	if !strings.Contains(lines[1], `"file":"eml/a/2.eml","path":"/eml/a/2"`) || !strings.Contains(lines[1], `"from":"a@x.com"`) {
+		t.Errorf("清单第2行为 %s", lines[1])
+	}
+}
+
+func TestDirExporterCollision(t *testing.T) {
+	dir := t.TempDir()
+	// 目录中已有的文件不会被覆盖
+	if err := os.WriteFile(filepath.Join(dir, "a.eml"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := NewDirExporter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []*Message{
+		{Path: "/a", Content: []byte("one")},
+		// 不同的路径导出为同一个文件名
+		{Path: "/a.eml", Content: []byte("two")},
+		// 重复的路径使用之前导出的文件
+		{Path: "/a", Content: []byte("one")},
+	}
+	for _, msg := range messages {
+		if err := exporter.Export(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"a.eml": "old", "a-1.eml": "one", "a-2.eml": "two"} {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Errorf("%s 的内容为 %q，期望 %q", name, content, want)
+		}
+	}
+	src, err := NewManifestSource(filepath.Join(dir, ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for _, want := range messages {
+		msg, err := src.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Path != want.Path || string(msg.Content) != string(want.Content) {
+			t.Errorf("读取到 %s：%q，期望 %s：%q", msg.Path, msg.Content, want.Path, want.Content)
+		}
+	}
+}
+
+func TestTarExporterAbort(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "replay.tar")
+	exporter, err := NewTarExporter(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exporter.Export(&Message{Path: "/1.eml", Content: []byte("one")}); err != nil {
+		t.Fatal(err)
+	}
+	// 关闭底层文件，模拟写入归档失败
+	exporter.(*tarExporter).file.Close()
+	if err := exporter.Export(&Message{Path: "/2.eml", Content: []byte("two")}); err == nil {
+		t.Fatal("写入失败时没有返回错误")
+	}
+	if err := exporter.Export(&Message{Path: "/3.eml", Content: []byte("three")}); err == nil {
+		t.Fatal("写入失败后继续导出时没有返回错误")
+	}
+	if err := exporter.Close(); err == nil {
+		t.Fatal("写入失败后关闭时没有返回错误")
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("损坏的归档没有删除：%v", err)
+	}
+}
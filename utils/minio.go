@@ -0,0 +1,218 @@
+package utils
+
+import (
+	ctx "context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// MinioOptions minio或其他S3兼容存储的连接配置
+type MinioOptions struct {
+	// Endpoint 为 地址:端口
+	Endpoint     string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Region       string
+	// Secure 为 true 时使用HTTPS
+	Secure bool
+	// CAFile 校验服务器证书使用的CA证书文件，为空时使用系统证书
+	CAFile string
+	// InsecureSkipVerify 为 true 时跳过服务器证书校验
+	InsecureSkipVerify bool
+}
+
+// NewMinioClient 根据配置创建minio client
+func NewMinioClient(opts MinioOptions) (*minio.Client, error) {
+	options := &minio.Options{
+		Creds:  credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, opts.SessionToken),
+		Secure: opts.Secure,
+		Region: opts.Region,
+	}
+	if opts.Secure && (opts.CAFile != "" || opts.InsecureSkipVerify) {
+		transport, err := minio.DefaultTransport(true)
+		if err != nil {
+			return nil, err
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = opts.InsecureSkipVerify
+		if opts.CAFile != "" {
+			pem, err := os.ReadFile(opts.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("CA证书文件中没有有效的证书：%s", opts.CAFile)
+			}
+			transport.TLSClientConfig.RootCAs = pool
+		}
+		options.Transport = transport
+	}
+	return minio.New(opts.Endpoint, options)
+}
+
+// MapRule 将以 PathPrefix 开头的路径映射到 Bucket 中，key 为去掉前缀后的路径加上 KeyPrefix
+type MapRule struct {
+	PathPrefix string
+	Bucket     string
+	KeyPrefix  string
+}
+
+// ParseMapRule 解析 路径前缀=bucket 或 路径前缀=bucket/key前缀 格式的映射规则
+func ParseMapRule(rule string) (MapRule, error) {
+	pathPrefix, target, ok := strings.Cut(rule, "=")
+	if !ok || target == "" {
+		return MapRule{}, fmt.Errorf("映射规则格式错误，应为 路径前缀=bucket/key前缀：%s", rule)
+	}
+	bucket, keyPrefix, _ := strings.Cut(target, "/")
+	return MapRule{PathPrefix: pathPrefix, Bucket: bucket, KeyPrefix: keyPrefix}, nil
+}
+
+// ObjectMapper 将clickhouse中记录的路径映射为bucket和key
+type ObjectMapper struct {
+	// Rules 按顺序匹配的映射规则
+	Rules []MapRule
+	// Bucket 没有匹配的规则时使用的bucket，为空时取路径的第一段作为bucket
+	Bucket string
+	// KeyPrefix 没有匹配的规则时在key前添加的前缀
+	KeyPrefix string
+}
+
+// Map 返回路径对应的bucket和key，默认将 /eml/a/b.eml 映射为bucket eml中的 a/b.eml
+func (m ObjectMapper) Map(path string) (string, string, error) {
+	for _, rule := range m.Rules {
+		if hasPathPrefix(path, rule.PathPrefix) {
+			return rule.Bucket, rule.KeyPrefix + strings.TrimPrefix(strings.TrimPrefix(path, rule.PathPrefix), "/"), nil
+		}
+	}
+	key := strings.TrimPrefix(path, "/")
+	bucket := m.Bucket
+	if bucket == "" {
+		var ok bool
+		if bucket, key, ok = strings.Cut(key, "/"); !ok || bucket == "" || key == "" {
+			return "", "", fmt.Errorf("无法从路径中获取bucket：%s", path)
+		}
+	}
+	return bucket, m.KeyPrefix + key, nil
+}
+
+// hasPathPrefix 判断 prefix 是否为 path 开头的完整路径段，/eml/a 不匹配 /eml/ab/c，空前缀匹配所有路径
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return prefix == "" || len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// MinioReader 按路径从minio中读取eml文件
+type MinioReader struct {
+	Client *minio.Client
+	Mapper ObjectMapper
+}
+
+// Read 读取路径对应的对象
+func (r *MinioReader) Read(path string) ([]byte, error) {
+	bucket, key, err := r.Mapper.Map(path)
+	if err != nil {
+		return nil, err
+	}
+	object, err := r.Client.GetObject(ctx.Background(), bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	return io.ReadAll(object)
+}
+
+// MinioListOptions 列举bucket中eml文件的条件
+type MinioListOptions struct {
+	Bucket string
+	Prefix string
+	// Since 和 Until 不为零值时只返回LastModified在该范围内的对象
+	Since time.Time
+	Until time.Time
+	// Glob 不为空时只返回匹配的对象，不包含 / 时匹配文件名，否则匹配完整的key
+	Glob string
+}
+
+type minioListSource struct {
+	client  *minio.Client
+	opts    MinioListOptions
+	load    Loader
+	objects <-chan minio.ObjectInfo
+	cancel  ctx.CancelFunc
+}
+
+// NewMinioListSource 列举bucket中的对象并通过 load 依次读取，不需要clickhouse中的索引，
+// 返回的路径为 /bucket/key，load 为 nil 时只返回路径，由 NewPrefetchSource 读取内容
+func NewMinioListSource(client *minio.Client, opts MinioListOptions, load Loader) (Source, error) {
+	if opts.Bucket == "" {
+		return nil, errors.New("列举对象时必须指定bucket")
+	}
+	if opts.Glob != "" {
+		if _, err := path.Match(opts.Glob, ""); err != nil {
+			return nil, fmt.Errorf("glob格式错误：%v", err)
+		}
+	}
+	c, cancel := ctx.WithCancel(ctx.Background())
+	objects := client.ListObjects(c, opts.Bucket, minio.ListObjectsOptions{Prefix: opts.Prefix, Recursive: true})
+	return &minioListSource{client: client, opts: opts, load: load, objects: objects, cancel: cancel}, nil
+}
+
+// match 判断对象是否满足列举条件
+func (s *minioListSource) match(object minio.ObjectInfo) bool {
+	if strings.HasSuffix(object.Key, "/") {
+		return false
+	}
+	if !s.opts.Since.IsZero() && object.LastModified.Before(s.opts.Since) {
+		return false
+	}
+	if !s.opts.Until.IsZero() && object.LastModified.After(s.opts.Until) {
+		return false
+	}
+	if s.opts.Glob != "" {
+		name := object.Key
+		if !strings.Contains(s.opts.Glob, "/") {
+			name = path.Base(name)
+		}
+		if ok, _ := path.Match(s.opts.Glob, name); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *minioListSource) Next() (*Message, error) {
+	for object := range s.objects {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		if !s.match(object) {
+			continue
+		}
+		msg := &Message{Path: "/" + s.opts.Bucket + "/" + object.Key, Timestamp: object.LastModified}
+		if s.load == nil {
+			return msg, nil
+		}
+		return msg, loadContent(msg, s.load)
+	}
+	return nil, io.EOF
+}
+
+func (s *minioListSource) Close() error {
+	s.cancel()
+	return nil
+}
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestParseMapRule(t *testing.T) {
+	tests := []struct {
+		rule    string
+		want    MapRule
+		wantErr bool
+	}{
+		{rule: "/eml=mail", want: MapRule{PathPrefix: "/eml", Bucket: "mail"}},
+		{rule: "/eml/2024=archive/eml/2024/", want: MapRule{PathPrefix: "/eml/2024", Bucket: "archive", KeyPrefix: "eml/2024/"}},
+		{rule: "=mail/all/", want: MapRule{Bucket: "mail", KeyPrefix: "all/"}},
+		{rule: "/eml", wantErr: true},
+		{rule: "/eml=", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMapRule(tt.rule)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMapRule(%q) err = %v，期望出错：%v", tt.rule, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMapRule(%q) = %+v，期望 %+v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestObjectMapperMap(t *testing.T) {
+	rule := func(s string) MapRule {
+		r, err := ParseMapRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	tests := []struct {
+		name    string
+		mapper  ObjectMapper
+		path    string
+		bucket  string
+		key     string
+		wantErr bool
+	}{
+		{name: "first segment as bucket", path: "/eml/a/b.eml", bucket: "eml", key: "a/b.eml"},
+		{name: "without leading slash", path: "eml/a/b.eml", bucket: "eml", key: "a/b.eml"},
+		{name: "no key", path: "/eml", wantErr: true},
+		{name: "empty", path: "", wantErr: true},
+		{name: "default bucket", mapper: ObjectMapper{Bucket: "mail", KeyPrefix: "raw/"}, path: "/eml/a/b.eml", bucket: "mail", key: "raw/eml/a/b.eml"},
+		{name: "rule", mapper: ObjectMapper{Rules: []MapRule{rule("/eml=mail/x/")}}, path: "/eml/a/b.eml", bucket: "mail", key: "x/a/b.eml"},
+		{name: "rule not matched", mapper: ObjectMapper{Rules: []MapRule{rule("/data=mail")}}, path: "/eml/a/b.eml", bucket: "eml", key: "a/b.eml"},
+		// 前缀按完整的路径段匹配
+		{name: "partial segment", mapper: ObjectMapper{Rules: []MapRule{rule("/eml/a=mail")}}, path: "/eml/ab/c.eml", bucket: "eml", key: "ab/c.eml"},
+		{name: "empty prefix", mapper: ObjectMapper{Rules: []MapRule{rule("=mail/all/")}}, path: "/eml/a/b.eml", bucket: "mail", key: "all/eml/a/b.eml"},
+		// 重叠的规则按顺序匹配第一个
+		{
+			name:   "overlapping specific first",
+			mapper: ObjectMapper{Rules: []MapRule{rule("/eml/2024=archive"), rule("/eml=mail"), rule("=other")}},
+			path:   "/eml/2024/a.eml", bucket: "archive", key: "a.eml",
+		},
+		{
+			name:   "overlapping general first",
+			mapper: ObjectMapper{Rules: []MapRule{rule("/eml=mail"), rule("/eml/2024=archive")}},
+			path:   "/eml/2024/a.eml", bucket: "mail", key: "2024/a.eml",
+		},
+		{
+			name:   "overlapping fallback",
+			mapper: ObjectMapper{Rules: []MapRule{rule("/eml/2024=archive"), rule("/eml=mail"), rule("=other")}},
+			path:   "/data/a.eml", bucket: "other", key: "data/a.eml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, key, err := tt.mapper.Map(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v，期望出错：%v", err, tt.wantErr)
+			}
+			if bucket != tt.bucket || key != tt.key {
+				t.Errorf("Map(%q) = %s, %s，期望 %s, %s", tt.path, bucket, key, tt.bucket, tt.key)
+			}
+		})
+	}
+}
+
+func TestMinioListSourceMatch(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	until := since.Add(time.Hour)
+	objects := []minio.ObjectInfo{
+		{Key: "2024/a.eml", LastModified: since.Add(-time.Nanosecond)},
+		{Key: "2024/b.eml", LastModified: since},
+		{Key: "2024/c.txt", LastModified: since.Add(time.Minute)},
+		{Key: "2024/sub/", LastModified: since.Add(time.Minute)},
+		{Key: "2024/sub/d.eml", LastModified: until},
+		{Key: "2024/e.eml", LastModified: until.Add(time.Nanosecond)},
+	}
+	tests := []struct {
+		name string
+		opts MinioListOptions
+		want string
+	}{
+		{name: "all", want: "2024/a.eml 2024/b.eml 2024/c.txt 2024/sub/d.eml 2024/e.eml"},
+		// Since 和 Until 都包含边界上的对象
+		{name: "since until", opts: MinioListOptions{Since: since, Until: until}, want: "2024/b.eml 2024/c.txt 2024/sub/d.eml"},
+		{name: "since", opts: MinioListOptions{Since: until}, want: "2024/sub/d.eml 2024/e.eml"},
+		{name: "until", opts: MinioListOptions{Until: since}, want: "2024/a.eml 2024/b.eml"},
+		{name: "glob name", opts: MinioListOptions{Glob: "*.eml"}, want: "2024/a.eml 2024/b.eml 2024/sub/d.eml 2024/e.eml"},
+		{name: "glob key", opts: MinioListOptions{Glob: "2024/*.eml"}, want: "2024/a.eml 2024/b.eml 2024/e.eml"},
+		{name: "glob no match", opts: MinioListOptions{Glob: "*.msg"}, want: ""},
+		{name: "glob and time", opts: MinioListOptions{Glob: "*.eml", Since: since, Until: until}, want: "2024/b.eml 2024/sub/d.eml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan minio.ObjectInfo, len(objects))
+			for _, object := range objects {
+				ch <- object
+			}
+			close(ch)
+			tt.opts.Bucket = "mail"
+			src := &minioListSource{opts: tt.opts, objects: ch, cancel: func() {}}
+			var got []string
+			for {
+				msg, err := src.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(msg.Path, "/mail/") || msg.Timestamp.IsZero() {
+					t.Errorf("Path = %s，Timestamp = %s", msg.Path, msg.Timestamp)
+				}
+				got = append(got, strings.TrimPrefix(msg.Path, "/mail/"))
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("得到 %q，期望 %s", got, tt.want)
+			}
+		})
+	}
+}
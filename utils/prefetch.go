@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"io"
+	"sync"
+)
+
+// prefetchItem 一封正在预读的邮件，done 关闭后 msg 和 err 可用
+type prefetchItem struct {
+	msg  *Message
+	err  error
+	done chan struct{}
+}
+
+type prefetchSource struct {
+	src   Source
+	load  Loader
+	items chan *prefetchItem
+	jobs  chan *prefetchItem
+	stop  chan struct{}
+	wg    sync.WaitGroup
+	once  sync.Once
+}
+
+// NewPrefetchSource 在后台使用 workers 个协程并发读取 src 返回的邮件内容，
+// 最多预读 size 封邮件，Next 按 src 的顺序返回，src 返回的邮件不应包含内容
+func NewPrefetchSource(src Source, load Loader, workers, size int) Source {
+	if workers < 1 {
+		workers = 1
+	}
+	if size < workers {
+		size = workers
+	}
+	s := &prefetchSource{
+		src:   src,
+		load:  load,
+		items: make(chan *prefetchItem, size),
+		jobs:  make(chan *prefetchItem),
+		stop:  make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		s.wg.Add(1)
+		go s.download()
+	}
+	s.wg.Add(1)
+	go s.feed()
+	return s
+}
+
+// feed 从 src 读取邮件，按顺序放入 items 并交给下载协程
+func (s *prefetchSource) feed() {
+	defer s.wg.Done()
+	defer close(s.items)
+	defer close(s.jobs)
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		msg, err := s.src.Next()
+		if err == io.EOF {
+			return
+		}
+		item := &prefetchItem{msg: msg, err: err, done: make(chan struct{})}
+		select {
+		case <-s.stop:
+			return
+		case s.items <- item:
+		}
+		if err != nil {
+			close(item.done)
+			if msg == nil {
+				return
+			}
+			continue
+		}
+		select {
+		case <-s.stop:
+			close(item.done)
+			return
+		case s.jobs <- item:
+		}
+	}
+}
+
+// download 下载协程，读取邮件内容
+func (s *prefetchSource) download() {
+	defer s.wg.Done()
+	for item := range s.jobs {
+		item.err = loadContent(item.msg, s.load)
+		close(item.done)
+	}
+}
+
+func (s *prefetchSource) Next() (*Message, error) {
+	item, ok := <-s.items
+	if !ok {
+		return nil, io.EOF
+	}
+	<-item.done
+	return item.msg, item.err
+}
+
+func (s *prefetchSource) Close() error {
+	s.once.Do(func() {
+		close(s.stop)
+		// 丢弃已经预读的邮件，避免 feed 阻塞
+		go func() {
+			for range s.items {
+			}
+		}()
+	})
+	s.wg.Wait()
+	return s.src.Close()
+}
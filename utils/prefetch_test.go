@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pathSource 按顺序返回只有路径的邮件
+type pathSource struct {
+	mu     sync.Mutex
+	paths  []string
+	index  int
+	closed bool
+}
+
+func newPathSource(n int) *pathSource {
+	s := &pathSource{}
+	for i := 0; i < n; i++ {
+		s.paths = append(s.paths, fmt.Sprintf("/eml/%03d.eml", i))
+	}
+	return s
+}
+
+func (s *pathSource) Next() (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.index >= len(s.paths) {
+		return nil, io.EOF
+	}
+	s.index++
+	return &Message{Path: s.paths[s.index-1]}, nil
+}
+
+func (s *pathSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestPrefetchSourceOrder(t *testing.T) {
+	// 下载耗时随机，先下载完成的邮件也要按来源的顺序返回，下载失败的邮件在原来的位置返回错误
+	src := newPathSource(200)
+	errLoad := errors.New("load failed")
+	var mu sync.Mutex
+	rnd := rand.New(rand.NewSource(1))
+	var inFlight, maxInFlight int32
+	load := func(path string) ([]byte, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		mu.Lock()
+		d := time.Duration(rnd.Intn(500)) * time.Microsecond
+		mu.Unlock()
+		time.Sleep(d)
+		if path == "/eml/050.eml" {
+			return nil, errLoad
+		}
+		return []byte("content of " + path), nil
+	}
+	s := NewPrefetchSource(src, load, 8, 16)
+	for i := 0; ; i++ {
+		msg, err := s.Next()
+		if err == io.EOF {
+			if i != len(src.paths) {
+				t.Fatalf("读取到 %d 封邮件，期望 %d 封", i, len(src.paths))
+			}
+			break
+		}
+		if msg == nil || msg.Path != src.paths[i] {
+			t.Fatalf("第%d封邮件为 %+v，期望 %s", i, msg, src.paths[i])
+		}
+		if i == 50 {
+			if err != errLoad {
+				t.Fatalf("第%d封邮件的错误为 %v", i, err)
+			}
+			continue
+		}
+		if err != nil || string(msg.Content) != "content of "+msg.Path {
+			t.Fatalf("第%d封邮件的内容为 %q，错误为 %v", i, msg.Content, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !src.closed {
+		t.Error("Close 没有关闭来源")
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max < 2 || max > 8 {
+		t.Errorf("同时下载的邮件数最多为 %d，期望在2到8之间", max)
+	}
+}
+
+func TestPrefetchSourceClose(t *testing.T) {
+	// 下载协程阻塞在下载中、预读队列已满时关闭，Close 等待下载结束后返回，不会泄漏协程
+	src := newPathSource(100)
+	release := make(chan struct{})
+	var started int32
+	load := func(path string) ([]byte, error) {
+		atomic.AddInt32(&started, 1)
+		<-release
+		return []byte(path), nil
+	}
+	s := NewPrefetchSource(src, load, 4, 8)
+	for atomic.LoadInt32(&started) < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	closed := make(chan error)
+	go func() { closed <- s.Close() }()
+	select {
+	case <-closed:
+		t.Fatal("下载没有结束时 Close 已经返回")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close 没有返回")
+	}
+	if !src.closed {
+		t.Error("Close 没有关闭来源")
+	}
+	// 关闭后不再读取来源，重复关闭不会阻塞
+	if src.index >= len(src.paths) {
+		t.Errorf("关闭后仍然读取了全部 %d 封邮件", src.index)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrefetchSourceError(t *testing.T) {
+	// 来源返回没有邮件的错误时停止读取
+	errSource := errors.New("source failed")
+	s := NewPrefetchSource(&failingSource{err: errSource}, func(string) ([]byte, error) { return nil, nil }, 2, 2)
+	defer s.Close()
+	if _, err := s.Next(); err != errSource {
+		t.Fatalf("错误为 %v，期望 %v", err, errSource)
+	}
+	if _, err := s.Next(); err != io.EOF {
+		t.Fatalf("错误为 %v，期望 io.EOF", err)
+	}
+}
+
+type failingSource struct{ err error }
+
+func (s *failingSource) Next() (*Message, error) { return nil, s.err }
+func (s *failingSource) Close() error            { return nil }
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// rcptColumnNames 表头中表示收件人地址列的列名，不区分大小写
+var rcptColumnNames = []string{"email", "e-mail", "mail", "address", "recipient", "rcpt", "to", "邮箱", "收件人"}
+
+// ReadRecipientFile 读取收件人列表文件，每行一个收件人，也可以是CSV格式，字段可以用双引号包围，以#开头的行会被忽略。
+// 第一行的所有字段都不包含@时作为表头，按列名选择地址列，没有匹配的列名时使用第一行数据中第一个包含@的列，
+// 其余列（如姓名）被忽略。地址列不包含@时视为格式错误，文件中没有收件人时返回错误
+func ReadRecipientFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var recipients []string
+	column := -1
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && isRecipientHeader(record) {
+			column = recipientColumn(record)
+			continue
+		}
+		if column < 0 {
+			column = addressColumn(record)
+		}
+		var addr string
+		if column < len(record) {
+			addr = strings.TrimSpace(record[column])
+		}
+		if !strings.Contains(addr, "@") {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("%s 第%d行的收件人格式错误：%s", path, line, addr)
+		}
+		recipients = append(recipients, addr)
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New(path + " 中没有收件人")
+	}
+	return recipients, nil
+}
+
+// isRecipientHeader 判断是否为表头，表头的字段都不是邮箱地址
+func isRecipientHeader(record []string) bool {
+	for _, field := range record {
+		if strings.Contains(field, "@") {
+			return false
+		}
+	}
+	return true
+}
+
+// recipientColumn 按表头的列名选择地址列，没有匹配的列名时返回 -1
+func recipientColumn(header []string) int {
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		for _, want := range rcptColumnNames {
+			if name == want {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// addressColumn 返回第一个包含@的列，都不包含时为第一列
+func addressColumn(record []string) int {
+	for i, field := range record {
+		if strings.Contains(field, "@") {
+			return i
+		}
+	}
+	return 0
+}
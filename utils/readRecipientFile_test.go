@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadRecipientFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+		wantErr bool
+	}{
+		{name: "one per line", content: "a@x.com\n\nb@x.com\n", want: []string{"a@x.com", "b@x.com"}},
+		{name: "comment", content: "a@x.com\n# comment\nc@x.com\n", want: []string{"a@x.com", "c@x.com"}},
+		{name: "quoted with comma", content: "\"Doe, John <a@x.com>\",John\n", want: []string{"Doe, John <a@x.com>"}},
+		// 没有表头时使用第一个包含@的列，其余列被忽略
+		{name: "email and name", content: "a@x.com,Alice\nb@x.com,Bob\n", want: []string{"a@x.com", "b@x.com"}},
+		{name: "name and email", content: "Alice,a@x.com\nBob,b@x.com\n", want: []string{"a@x.com", "b@x.com"}},
+		{name: "header by name", content: "name,Email,backup\nAlice,a@x.com,c@x.com\nBob,b@x.com,\n", want: []string{"a@x.com", "b@x.com"}},
+		{name: "header without known name", content: "who,addr\nAlice,a@x.com\n", want: []string{"a@x.com"}},
+		{name: "invalid address", content: "a@x.com,Alice\nBob\n", wantErr: true},
+		{name: "header column empty", content: "email,name\n,Alice\n", wantErr: true},
+		{name: "empty", content: "# only comments\n\n", wantErr: true},
+		{name: "header only", content: "email\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rcpt.csv")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadRecipientFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v，期望出错：%v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q，期望 %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Message 一封待发送的邮件
+type Message struct {
+	// Path 本地文件路径或对象存储中的路径
+	Path    string
+	Content []byte
+	// Envelope 邮件自带的信封，为 nil 时由发件引擎决定发件人和收件人
+	Envelope *Envelope
+	// Timestamp 邮件原始的到达时间，来源无法提供时为零值
+	Timestamp time.Time
+	// FetchDuration 从对象存储下载邮件内容的耗时，本地文件为0
+	FetchDuration time.Duration
+}
+
+// Loader 按路径读取邮件内容
+type Loader func(path string) ([]byte, error)
+
+// loadContent 通过 load 读取邮件内容并记录读取耗时
+func loadContent(msg *Message, load Loader) error {
+	start := time.Now()
+	content, err := load(msg.Path)
+	msg.Content, msg.FetchDuration = content, time.Since(start)
+	return err
+}
+
+// Envelope SMTP信封
+type Envelope struct {
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	// ClientIP 原始客户端IP，服务器支持XCLIENT时可以用于还原客户端地址
+	ClientIP string `json:"clientIP,omitempty"`
+}
+
+// Source 邮件来源
+// Next 在没有更多邮件时返回 io.EOF；
+// 返回错误且 Message 不为 nil 表示该封邮件读取失败，可以继续调用 Next，
+// 返回错误且 Message 为 nil 表示来源已不可用
+type Source interface {
+	Next() (*Message, error)
+	Close() error
+}
+
+var errSourceClosed = errors.New("source closed")
+
+type dirSource struct {
+	paths chan string
+	done  chan struct{}
+	err   error
+}
+
+// NewDirSource 遍历目录下的eml文件，边遍历边读取，不会预先加载整个文件列表
+func NewDirSource(dir string) (Source, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New(dir + " 不是目录")
+	}
+	s := &dirSource{paths: make(chan string), done: make(chan struct{})}
+	go func() {
+		defer close(s.paths)
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || filepath.Ext(path) != ".eml" {
+				return nil
+			}
+			select {
+			case s.paths <- path:
+				return nil
+			case <-s.done:
+				return errSourceClosed
+			}
+		})
+		if err != errSourceClosed {
+			s.err = err
+		}
+	}()
+	return s, nil
+}
+
+func (s *dirSource) Next() (*Message, error) {
+	path, ok := <-s.paths
+	if !ok {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	content, err := ReadEmlFile(path)
+	return &Message{Path: path, Content: content}, err
+}
+
+func (s *dirSource) Close() error {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	return nil
+}
+
+type listFileSource struct {
+	file    io.Closer
+	scanner *bufio.Scanner
+}
+
+// NewListFileSource 从文件中按行读取eml文件路径，listPath 为 - 时从标准输入读取
+func NewListFileSource(listPath string) (Source, error) {
+	if listPath == "-" {
+		return &listFileSource{scanner: bufio.NewScanner(os.Stdin)}, nil
+	}
+	file, err := os.Open(listPath)
+	if err != nil {
+		return nil, err
+	}
+	return &listFileSource{file: file, scanner: bufio.NewScanner(file)}, nil
+}
+
+func (s *listFileSource) Next() (*Message, error) {
+	for s.scanner.Scan() {
+		path := strings.TrimSpace(s.scanner.Text())
+		if path == "" || strings.HasPrefix(path, "#") {
+			continue
+		}
+		content, err := ReadEmlFile(path)
+		return &Message{Path: path, Content: content}, err
+	}
+	if err := s.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (s *listFileSource) Close() error {
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
+
+type readerSource struct {
+	name   string
+	reader io.Reader
+	done   bool
+}
+
+// NewReaderSource 将 reader 中的全部内容作为一封邮件，用于从标准输入读取邮件
+func NewReaderSource(name string, reader io.Reader) Source {
+	return &readerSource{name: name, reader: reader}
+}
+
+func (s *readerSource) Next() (*Message, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+	s.done = true
+	content, err := io.ReadAll(s.reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Path: s.name, Content: content}, nil
+}
+
+func (s *readerSource) Close() error {
+	return nil
+}
+
+// ReadEmlFile 读取本地eml文件
+func ReadEmlFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}